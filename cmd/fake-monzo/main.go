@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/tlwr/monzo-exporter/fakemonzo"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	fixturesPath = kingpin.Flag("fixtures", "JSON file of users, accounts, pots and transactions").Required().String()
+	port         = kingpin.Flag("port", "The port to bind to").Default("8081").Int()
+)
+
+func main() {
+	kingpin.Parse()
+
+	contents, err := ioutil.ReadFile(*fixturesPath)
+	if err != nil {
+		fmt.Printf("Could not read fixtures: %s\n", err)
+		os.Exit(1)
+	}
+
+	var fixtures fakemonzo.Fixtures
+	err = json.Unmarshal(contents, &fixtures)
+	if err != nil {
+		fmt.Printf("Could not unmarshal fixtures: %s\n", err)
+		os.Exit(1)
+	}
+
+	server := fakemonzo.NewServer(fixtures)
+
+	http.HandleFunc("/fake/errors", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			server.ClearErrors()
+			return
+		}
+
+		var injected fakemonzo.InjectedError
+		err := json.NewDecoder(r.Body).Decode(&injected)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("400 - %s", err)))
+			return
+		}
+
+		server.InjectError(r.URL.Query().Get("path"), injected)
+	})
+	http.HandleFunc("/fake/approve", func(w http.ResponseWriter, r *http.Request) {
+		server.Approve(r.URL.Query().Get("user_id"))
+	})
+	http.Handle("/", server)
+
+	log.Printf("main: Serving fake Monzo on :%d", *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+}
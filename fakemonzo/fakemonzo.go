@@ -0,0 +1,561 @@
+// Package fakemonzo is a fake of the parts of the Monzo API used by the
+// exporter, for running the exporter without talking to a real bank
+//
+// Users, accounts, balances, pots and transactions are set up as Fixtures,
+// and errors can be injected for any path
+package fakemonzo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUTH_PATH = "/auth"
+
+	TOKEN_EXPIRY_SECONDS = 21600
+)
+
+type Fixtures struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+
+	// AuthorizeAs is the user signed in by the fake auth page
+	AuthorizeAs string `json:"authorize_as"`
+
+	Users []*User `json:"users"`
+}
+
+type User struct {
+	UserID       string `json:"user_id"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+
+	// Approved is false until the user approves access in the Monzo app
+	Approved bool `json:"approved"`
+
+	Accounts []*Account `json:"accounts"`
+}
+
+type Account struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+
+	Balance      Balance       `json:"balance"`
+	Pots         []Pot         `json:"pots"`
+	Transactions []Transaction `json:"transactions"`
+}
+
+type Balance struct {
+	Balance      int64  `json:"balance"`
+	TotalBalance int64  `json:"total_balance"`
+	Currency     string `json:"currency"`
+	SpendToday   int64  `json:"spend_today"`
+}
+
+type Pot struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Currency string    `json:"currency"`
+	Balance  int64     `json:"balance"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Transaction is served as is, apart from account_id which is filled in
+type Transaction map[string]interface{}
+
+func (t Transaction) created() time.Time {
+	created, _ := t["created"].(string)
+	parsed, _ := time.Parse(time.RFC3339Nano, created)
+	return parsed
+}
+
+func (t Transaction) id() string {
+	id, _ := t["id"].(string)
+	return id
+}
+
+// InjectedError is returned instead of the real response for a path
+type InjectedError struct {
+	StatusCode int    `json:"status_code"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+
+	// Times is how many requests fail, or forever when it is 0
+	Times int `json:"times"`
+}
+
+type Server struct {
+	lock sync.Mutex
+
+	fixtures Fixtures
+	codes    map[string]string
+	errors   map[string]*InjectedError
+	requests map[string]int
+}
+
+func NewServer(fixtures Fixtures) *Server {
+	return &Server{
+		fixtures: fixtures,
+		codes:    make(map[string]string),
+		errors:   make(map[string]*InjectedError),
+		requests: make(map[string]int),
+	}
+}
+
+// SetFixtures replaces every user, account and transaction
+func (s *Server) SetFixtures(fixtures Fixtures) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.fixtures = fixtures
+}
+
+// Update calls fun with the fixtures, so they can be changed in place
+func (s *Server) Update(fun func(*Fixtures)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fun(&s.fixtures)
+}
+
+// Approve stands in for the user approving access in the Monzo app
+func (s *Server) Approve(userID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, user := range s.fixtures.Users {
+		if user.UserID == userID {
+			user.Approved = true
+		}
+	}
+}
+
+func (s *Server) InjectError(path string, injected InjectedError) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.errors[path] = &injected
+}
+
+func (s *Server) ClearErrors() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.errors = make(map[string]*InjectedError)
+}
+
+// Requests is the number of requests made to a path
+func (s *Server) Requests(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.requests[path]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := r.URL.Path
+	s.requests[path]++
+	log.Printf("fakemonzo: %s %s", r.Method, r.URL)
+
+	if injected, ok := s.errors[path]; ok {
+		if injected.Times > 0 {
+			injected.Times--
+			if injected.Times == 0 {
+				delete(s.errors, path)
+			}
+		}
+
+		writeError(w, injected.StatusCode, injected.Code, injected.Message)
+		return
+	}
+
+	switch path {
+	case AUTH_PATH:
+		s.handleAuth(w, r)
+	case "/oauth2/token":
+		s.handleToken(w, r)
+	case "/oauth2/logout":
+		s.withUser(w, r, false, s.handleLogout)
+	case "/ping/whoami":
+		s.withUser(w, r, false, s.handleWhoAmI)
+	case "/accounts":
+		s.withUser(w, r, true, s.handleAccounts)
+	case "/balance":
+		s.withUser(w, r, true, s.handleBalance)
+	case "/pots":
+		s.withUser(w, r, true, s.handlePots)
+	case "/transactions":
+		s.withUser(w, r, true, s.handleTransactions)
+	default:
+		if strings.HasPrefix(path, "/transactions/") {
+			s.withUser(w, r, true, s.handleTransaction)
+			return
+		}
+
+		writeError(w, http.StatusNotFound, "not_found", "Not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, map[string]string{"code": code, "message": message})
+}
+
+func randomString() string {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(randomBytes)
+}
+
+func (s *Server) userByAccessToken(accessToken string) *User {
+	for _, user := range s.fixtures.Users {
+		if user.AccessToken != "" && user.AccessToken == accessToken {
+			return user
+		}
+	}
+	return nil
+}
+
+func (s *Server) withUser(
+	w http.ResponseWriter, r *http.Request, needsApproval bool,
+	handler func(http.ResponseWriter, *http.Request, *User),
+) {
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	user := s.userByAccessToken(accessToken)
+
+	if user == nil {
+		writeError(
+			w, http.StatusUnauthorized,
+			"unauthorized.bad_access_token", "Access token is invalid",
+		)
+		return
+	}
+
+	if needsApproval && !user.Approved {
+		writeError(
+			w, http.StatusForbidden,
+			"forbidden.insufficient_permissions",
+			"Access forbidden due to insufficient permissions",
+		)
+		return
+	}
+
+	handler(w, r, user)
+}
+
+func (u *User) account(accountID string) *Account {
+	for _, account := range u.Accounts {
+		if account.ID == accountID {
+			return account
+		}
+	}
+	return nil
+}
+
+// handleAuth stands in for auth.monzo.com, immediately signing in the
+// AuthorizeAs user and sending them back with a code
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirectURI.String() == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Bad redirect_uri")
+		return
+	}
+
+	code := randomString()
+	s.codes[code] = s.fixtures.AuthorizeAs
+
+	redirectQuery := redirectURI.Query()
+	redirectQuery.Set("code", code)
+	redirectQuery.Set("state", query.Get("state"))
+	redirectURI.RawQuery = redirectQuery.Encode()
+
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Use POST")
+		return
+	}
+
+	err := r.ParseMultipartForm(1 << 20)
+	if err == http.ErrNotMultipart {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	if r.FormValue("client_id") != s.fixtures.ClientID ||
+		r.FormValue("client_secret") != s.fixtures.ClientSecret {
+		writeError(
+			w, http.StatusUnauthorized,
+			"unauthorized.bad_client_credentials", "Client credentials are invalid",
+		)
+		return
+	}
+
+	var user *User
+
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		userID, ok := s.codes[r.FormValue("code")]
+		delete(s.codes, r.FormValue("code"))
+
+		for _, candidate := range s.fixtures.Users {
+			if ok && candidate.UserID == userID {
+				user = candidate
+			}
+		}
+
+		if user == nil {
+			writeError(
+				w, http.StatusUnauthorized,
+				"unauthorized.bad_authorization_code", "Authorization code is invalid",
+			)
+			return
+		}
+
+		// A new journey always needs approving in the app again
+		user.Approved = false
+
+	case "refresh_token":
+		for _, candidate := range s.fixtures.Users {
+			if candidate.RefreshToken != "" && candidate.RefreshToken == r.FormValue("refresh_token") {
+				user = candidate
+			}
+		}
+
+		if user == nil {
+			writeError(
+				w, http.StatusUnauthorized,
+				"unauthorized.bad_refresh_token", "Refresh token is invalid",
+			)
+			return
+		}
+
+	default:
+		writeError(
+			w, http.StatusBadRequest,
+			"bad_request.unsupported_grant_type", "Unsupported grant type",
+		)
+		return
+	}
+
+	user.AccessToken = randomString()
+	user.RefreshToken = randomString()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  user.AccessToken,
+		"refresh_token": user.RefreshToken,
+		"user_id":       user.UserID,
+		"client_id":     s.fixtures.ClientID,
+		"token_type":    "Bearer",
+		"expires_in":    TOKEN_EXPIRY_SECONDS,
+	})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request, user *User) {
+	user.AccessToken = ""
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (s *Server) handleWhoAmI(w http.ResponseWriter, r *http.Request, user *User) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"authenticated": true,
+		"client_id":     s.fixtures.ClientID,
+		"user_id":       user.UserID,
+	})
+}
+
+func (s *Server) handleAccounts(w http.ResponseWriter, r *http.Request, user *User) {
+	accounts := make([]map[string]interface{}, 0)
+	for _, account := range user.Accounts {
+		accounts = append(accounts, map[string]interface{}{
+			"id":          account.ID,
+			"description": account.Description,
+			"created":     account.Created,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"accounts": accounts})
+}
+
+func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request, user *User) {
+	account := user.account(r.URL.Query().Get("account_id"))
+	if account == nil {
+		writeError(w, http.StatusNotFound, "not_found.account", "Account not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, account.Balance)
+}
+
+func (s *Server) handlePots(w http.ResponseWriter, r *http.Request, user *User) {
+	account := user.account(r.URL.Query().Get("current_account_id"))
+	if account == nil {
+		writeError(w, http.StatusNotFound, "not_found.account", "Account not found")
+		return
+	}
+
+	pots := account.Pots
+	if pots == nil {
+		pots = make([]Pot, 0)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pots": pots})
+}
+
+func (a *Account) served(transaction Transaction) Transaction {
+	served := Transaction{"account_id": a.ID}
+	for key, value := range transaction {
+		served[key] = value
+	}
+	return served
+}
+
+// sortedTransactions are oldest first, which is the order Monzo lists them in
+func (a *Account) sortedTransactions() []Transaction {
+	transactions := make([]Transaction, len(a.Transactions))
+	copy(transactions, a.Transactions)
+
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].created().Before(transactions[j].created())
+	})
+
+	return transactions
+}
+
+// handleTransactions pages like Monzo, where since is a time or the ID of the
+// last transaction seen, before is a time and limit is at most 100
+func (s *Server) handleTransactions(w http.ResponseWriter, r *http.Request, user *User) {
+	query := r.URL.Query()
+
+	account := user.account(query.Get("account_id"))
+	if account == nil {
+		writeError(w, http.StatusNotFound, "not_found.account", "Account not found")
+		return
+	}
+
+	transactions := account.sortedTransactions()
+
+	if since := query.Get("since"); since != "" {
+		if parsed, err := time.Parse(time.RFC3339, since); err == nil {
+			start := len(transactions)
+			for i, transaction := range transactions {
+				if !transaction.created().Before(parsed) {
+					start = i
+					break
+				}
+			}
+			transactions = transactions[start:]
+		} else {
+			start := -1
+			for i, transaction := range transactions {
+				if transaction.id() == since {
+					start = i + 1
+					break
+				}
+			}
+
+			if start < 0 {
+				writeError(
+					w, http.StatusBadRequest,
+					"bad_request.bad_param.since", fmt.Sprintf("Bad since => %s", since),
+				)
+				return
+			}
+			transactions = transactions[start:]
+		}
+	}
+
+	if before := query.Get("before"); before != "" {
+		parsed, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			writeError(
+				w, http.StatusBadRequest,
+				"bad_request.bad_param.before", fmt.Sprintf("Bad before => %s", err),
+			)
+			return
+		}
+
+		end := len(transactions)
+		for i, transaction := range transactions {
+			if !transaction.created().Before(parsed) {
+				end = i
+				break
+			}
+		}
+		transactions = transactions[:end]
+	}
+
+	limit := 100
+	if query.Get("limit") != "" {
+		parsed, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || parsed < 1 || parsed > 100 {
+			writeError(
+				w, http.StatusBadRequest,
+				"bad_request.bad_param.limit", fmt.Sprintf("Bad limit => %s", query.Get("limit")),
+			)
+			return
+		}
+		limit = parsed
+	}
+
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+	}
+
+	served := make([]Transaction, 0, len(transactions))
+	for _, transaction := range transactions {
+		served = append(served, account.served(transaction))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"transactions": served,
+	})
+}
+
+func (s *Server) handleTransaction(w http.ResponseWriter, r *http.Request, user *User) {
+	id := strings.TrimPrefix(r.URL.Path, "/transactions/")
+
+	for _, account := range user.Accounts {
+		for _, transaction := range account.Transactions {
+			if transaction.id() == id {
+				writeJSON(w, http.StatusOK, map[string]interface{}{
+					"transaction": account.served(transaction),
+				})
+				return
+			}
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "not_found.transaction", "Transaction not found")
+}
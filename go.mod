@@ -3,12 +3,9 @@ module github.com/tlwr/monzo-exporter
 go 1.14
 
 require (
-	github.com/h2non/gentleman v2.0.5+incompatible
-	github.com/nbio/st v0.0.0-20140626010706-e9e8d9816f32 // indirect
 	github.com/prometheus/client_golang v0.9.4
 	github.com/robfig/cron v1.2.0
 	github.com/thejerf/suture v3.0.3+incompatible
-	golang.org/x/net v0.0.0-20210119194325-5f4716e94777 // indirect
+	go.etcd.io/bbolt v1.3.6
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
-	gopkg.in/h2non/gentleman.v2 v2.0.5 // indirect
 )
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,29 +9,254 @@ import (
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/robfig/cron"
 	"github.com/thejerf/suture"
 	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/tlwr/monzo-exporter/monzo"
 )
 
 var (
 	version = "0.0.1"
 
-	monzoOAuthClientID        = kingpin.Flag("monzo-oauth-client-id", "Monzo OAuth client id").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_CLIENT_ID").String()
-	monzoOAuthClientSecret    = kingpin.Flag("monzo-oauth-client-secret", "Monzo OAuth client secret").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_CLIENT_SECRET").String()
-	monzoOAuthPort            = kingpin.Flag("monzo-oauth-port", "The port to bind to for serving OAuth").Default("8080").OverrideDefaultFromEnvar("MONZO_OAUTH_PORT").Int()
-	monzoOAuthExternalURL     = kingpin.Flag("monzo-oauth-external-url", "The URL on which the exporter will be reachable").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_EXTERNAL_URL").String()
-	monzoOAuthRefreshInterval = kingpin.Flag("monzo-oauth-refresh-interval", "Time in seconds between OAuth token refreshes").Default("10").OverrideDefaultFromEnvar("MONZO_OAUTH_REFRESH_INTERVAL").Int64()
+	monzoOAuthClientID          = kingpin.Flag("monzo-oauth-client-id", "Monzo OAuth client id").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_CLIENT_ID").String()
+	monzoOAuthClientSecret      = kingpin.Flag("monzo-oauth-client-secret", "Monzo OAuth client secret").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_CLIENT_SECRET").String()
+	monzoOAuthPort              = kingpin.Flag("monzo-oauth-port", "The port to bind to for serving OAuth").Default("8080").OverrideDefaultFromEnvar("MONZO_OAUTH_PORT").Int()
+	monzoOAuthExternalURL       = kingpin.Flag("monzo-oauth-external-url", "The URL on which the exporter will be reachable").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_EXTERNAL_URL").String()
+	monzoOAuthRefreshInterval   = kingpin.Flag("monzo-oauth-refresh-interval", "Time in seconds between checks for OAuth tokens which need refreshing").Default("10").OverrideDefaultFromEnvar("MONZO_OAUTH_REFRESH_INTERVAL").Int64()
+	monzoOAuthRefreshLead       = kingpin.Flag("monzo-oauth-refresh-lead", "Time in seconds before expiry at which OAuth tokens are refreshed").Default("600").OverrideDefaultFromEnvar("MONZO_OAUTH_REFRESH_LEAD").Int64()
+	monzoOAuthTokenStore        = kingpin.Flag("monzo-oauth-token-store", "Where OAuth tokens are kept: memory or file").Default(TOKEN_STORE_MEMORY).OverrideDefaultFromEnvar("MONZO_OAUTH_TOKEN_STORE").Enum(TOKEN_STORE_MEMORY, TOKEN_STORE_FILE)
+	monzoOAuthTokenStorePath    = kingpin.Flag("monzo-oauth-token-store-path", "The file in which OAuth tokens are kept when using the file token store").Default("monzo-exporter-tokens.json").OverrideDefaultFromEnvar("MONZO_OAUTH_TOKEN_STORE_PATH").String()
+	monzoOAuthTokenStoreKey     = kingpin.Flag("monzo-oauth-token-store-key", "Hex encoded 32 byte key for encrypting the file token store").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_TOKEN_STORE_KEY").String()
+	monzoOAuthTokenStoreKeyFile = kingpin.Flag("monzo-oauth-token-store-key-file", "File containing the hex encoded 32 byte key for encrypting the file token store").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_TOKEN_STORE_KEY_FILE").String()
+
+	monzoAPIURL          = kingpin.Flag("monzo-api-url", "The URL of the Monzo API").Default(DefaultMonzoAPIEndpoint).OverrideDefaultFromEnvar("MONZO_API_URL").String()
+	monzoAPITimeout      = kingpin.Flag("monzo-api-timeout", "Time in seconds before a request to the Monzo API is abandoned").Default("30").OverrideDefaultFromEnvar("MONZO_API_TIMEOUT").Int64()
+	monzoAPIMaxRetries   = kingpin.Flag("monzo-api-max-retries", "The number of times a throttled or failed GET request to the Monzo API is retried").Default("3").OverrideDefaultFromEnvar("MONZO_API_MAX_RETRIES").Int()
+	monzoAPIGlobalBudget = kingpin.Flag("monzo-api-global-budget", "The number of requests per minute to the Monzo API for all users, 0 for no limit").Default("0").OverrideDefaultFromEnvar("MONZO_API_GLOBAL_BUDGET").Int()
+	monzoAPITokenBudget  = kingpin.Flag("monzo-api-token-budget", "The number of requests per minute to the Monzo API per access token, 0 for no limit").Default("0").OverrideDefaultFromEnvar("MONZO_API_TOKEN_BUDGET").Int()
+	monzoAuthURL         = kingpin.Flag("monzo-auth-url", "The URL to which users are sent to sign in to Monzo").Default(DefaultMonzoAuthEndpoint).OverrideDefaultFromEnvar("MONZO_AUTH_URL").String()
 
 	monzoAccessTokens = kingpin.Flag("monzo-access-tokens", "Monzo access tokens comma separated").Default("").OverrideDefaultFromEnvar("MONZO_ACCESS_TOKENS").String()
 
-	metricsScrapeInterval = kingpin.Flag("scrape-interval", "Time in seconds between scrapes").Default("30").OverrideDefaultFromEnvar("METRICS_SCRAPE_INTERVAL").Int64()
-	metricsPort           = kingpin.Flag("metrics-port", "The port to bind to for serving metrics").Default("9036").OverrideDefaultFromEnvar("METRICS_PORT").Int()
+	transactionStore          = kingpin.Flag("transaction-store", "Where synced transactions are kept: memory or ledger").Default(TRANSACTION_STORE_MEMORY).OverrideDefaultFromEnvar("TRANSACTION_STORE").Enum(TRANSACTION_STORE_MEMORY, TRANSACTION_STORE_LEDGER)
+	transactionStorePath      = kingpin.Flag("transaction-store-path", "The database in which synced transactions are kept when using the ledger transaction store").Default("monzo-exporter-ledger.db").OverrideDefaultFromEnvar("TRANSACTION_STORE_PATH").String()
+	transactionAutoBackfill   = kingpin.Flag("auto-backfill", "Backfill the history of each account into the ledger transaction store whilst collecting, ignored by the memory transaction store").Default("true").OverrideDefaultFromEnvar("TRANSACTION_AUTO_BACKFILL").Bool()
+	timezone                  = kingpin.Flag("timezone", "The timezone in which days start and end").Default("Europe/London").OverrideDefaultFromEnvar("TIMEZONE").String()
+	monthStartDay             = kingpin.Flag("month-start-day", "The day of the month on which months start for month to date spending, such as payday").Default("1").OverrideDefaultFromEnvar("MONTH_START_DAY").Int()
+	dailyResetSchedule        = kingpin.Flag("daily-reset-schedule", "Cron schedule in the timezone on which the amounts transacted today are reset").Default("@midnight").OverrideDefaultFromEnvar("DAILY_RESET_SCHEDULE").String()
+	transactionAmountBuckets  = kingpin.Flag("transaction-amount-buckets", "Comma separated histogram buckets in minor units for the amounts spent by transactions").Default("100,500,1000,2500,5000,10000,25000,50000").OverrideDefaultFromEnvar("TRANSACTION_AMOUNT_BUCKETS").String()
+	metricsScrapeInterval     = kingpin.Flag("scrape-interval", "Time in seconds between scrapes").Default("30").OverrideDefaultFromEnvar("METRICS_SCRAPE_INTERVAL").Int64()
+	metricsCollectConcurrency = kingpin.Flag("collect-concurrency", "The number of users and accounts to collect metrics for concurrently").Default("4").OverrideDefaultFromEnvar("METRICS_COLLECT_CONCURRENCY").Int()
+	metricsCollectOnScrape    = kingpin.Flag("collect-on-scrape", "Serve the latest collection on each scrape, so that series which were not collected disappear").Default("false").OverrideDefaultFromEnvar("METRICS_COLLECT_ON_SCRAPE").Bool()
+	metricsScrapeRefreshAge   = kingpin.Flag("scrape-refresh-min-age", "With --collect-on-scrape, time in seconds after which a scrape waits for a new collection, 0 to never").Default("0").OverrideDefaultFromEnvar("METRICS_SCRAPE_REFRESH_MIN_AGE").Int64()
+	metricsPort               = kingpin.Flag("metrics-port", "The port to bind to for serving metrics").Default("9036").OverrideDefaultFromEnvar("METRICS_PORT").Int()
+
+	serveCommand = kingpin.Command("serve", "Serve metrics and the OAuth journey").Default()
+
+	backfillCommand = kingpin.Command("backfill", "Backfill the history of every account into the ledger transaction store, whilst the exporter is stopped")
+
+	rotateTokenStoreKeyCommand = kingpin.Command("rotate-token-store-key", "Re-encrypt the file token store under a new key")
+	rotateTokenStoreNewKey     = rotateTokenStoreKeyCommand.Flag("new-key", "Hex encoded 32 byte key to re-encrypt the token store with, empty to decrypt it").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_TOKEN_STORE_NEW_KEY").String()
+	rotateTokenStoreNewKeyFile = rotateTokenStoreKeyCommand.Flag("new-key-file", "File containing the key to re-encrypt the token store with").Default("").OverrideDefaultFromEnvar("MONZO_OAUTH_TOKEN_STORE_NEW_KEY_FILE").String()
 )
 
 func main() {
-	kingpin.Parse()
+	switch kingpin.Parse() {
+	case serveCommand.FullCommand():
+		serve()
+	case backfillCommand.FullCommand():
+		backfill()
+	case rotateTokenStoreKeyCommand.FullCommand():
+		rotateTokenStoreKey()
+	}
+}
+
+func rotateTokenStoreKey() {
+	oldKey, err := LoadTokenStoreKey(
+		*monzoOAuthTokenStoreKey, *monzoOAuthTokenStoreKeyFile,
+	)
+	if err != nil {
+		fmt.Printf("Could not load current token store key: %s\n", err)
+		os.Exit(1)
+	}
+
+	newKey, err := LoadTokenStoreKey(
+		*rotateTokenStoreNewKey, *rotateTokenStoreNewKeyFile,
+	)
+	if err != nil {
+		fmt.Printf("Could not load new token store key: %s\n", err)
+		os.Exit(1)
+	}
+
+	count, err := RotateTokenStoreKey(*monzoOAuthTokenStorePath, oldKey, newKey)
+	if err != nil {
+		fmt.Printf("Could not rotate token store key: %s\n", err)
+		os.Exit(1)
+	}
+
+	if newKey == nil {
+		fmt.Printf("Decrypted %d tokens in %s\n", count, *monzoOAuthTokenStorePath)
+		return
+	}
+
+	fmt.Printf(
+		"Re-encrypted %d tokens in %s with key %s\n",
+		count, *monzoOAuthTokenStorePath, tokenStoreKeyID(newKey),
+	)
+}
+
+func configureMonzoAPI() {
+	MonzoAPIEndpoint = strings.TrimSuffix(*monzoAPIURL, "/")
+	MonzoAPITimeout = time.Duration(*monzoAPITimeout) * time.Second
+
+	monzoAPITransport := monzo.NewRetryTransport(
+		&MonzoAPIInstrumentedTransport{},
+		*monzoAPIGlobalBudget, *monzoAPITokenBudget,
+	)
+	monzoAPITransport.MaxRetries = *monzoAPIMaxRetries
+	monzoAPITransport.OnRetry = IncMonzoAPIRetries
+	monzoAPITransport.OnBudgetExhausted = IncMonzoAPIBudgetExhausted
+	MonzoAPIHTTPClient = &http.Client{Transport: monzoAPITransport}
+}
+
+// backfillAccessTokens are the tokens given on the command line, otherwise
+// those of every active user in the token store
+func backfillAccessTokens() []string {
+	if *monzoAccessTokens != "" {
+		return strings.Split(*monzoAccessTokens, ",")
+	}
+
+	tokenStoreKey, err := LoadTokenStoreKey(
+		*monzoOAuthTokenStoreKey, *monzoOAuthTokenStoreKeyFile,
+	)
+	if err != nil {
+		fmt.Printf("Could not load token store key: %s\n", err)
+		os.Exit(1)
+	}
+
+	tokenStore, err := NewMonzoTokenStore(
+		*monzoOAuthTokenStore, *monzoOAuthTokenStorePath, tokenStoreKey,
+	)
+	if err != nil {
+		fmt.Printf("Could not configure token store: %s\n", err)
+		os.Exit(1)
+	}
+
+	tokens, err := tokenStore.Load()
+	if err != nil {
+		fmt.Printf("Could not load token store: %s\n", err)
+		os.Exit(1)
+	}
+
+	accessTokens := make([]string, 0)
+	for _, token := range tokens {
+		if token.AuthState != "" && token.AuthState != USER_AUTH_STATE_ACTIVE {
+			fmt.Printf("Skipping user %s in state %s\n", token.UserID, token.AuthState)
+			continue
+		}
+
+		if token.ExpiryTime.Before(time.Now()) {
+			fmt.Printf("Skipping user %s whose access token has expired\n", token.UserID)
+			continue
+		}
+
+		accessTokens = append(accessTokens, string(token.AccessToken))
+	}
+	return accessTokens
+}
+
+func backfill() {
+	RegisterCustomMetrics()
+	configureMonzoAPI()
+
+	if *transactionStore != TRANSACTION_STORE_LEDGER {
+		fmt.Println("Backfilling requires --transaction-store=ledger")
+		os.Exit(1)
+	}
+
+	ledger, err := NewLedgerMonzoTransactionStore(*transactionStorePath)
+	if err != nil {
+		fmt.Printf("Could not open ledger, is the exporter still running? %s\n", err)
+		os.Exit(1)
+	}
+	defer ledger.Close()
+
+	backfiller := NewMonzoTransactionBackfiller(ledger)
+	ctx := context.Background()
+	failed := false
+
+	for _, token := range backfillAccessTokens() {
+		api := NewMonzoAPI(token)
+
+		identity, err := api.WhoAmI(ctx)
+		if err != nil {
+			fmt.Printf("Could not identify user: %s\n", err)
+			failed = true
+			continue
+		}
+
+		accounts, err := api.ListAccounts(ctx)
+		if err != nil {
+			fmt.Printf("Could not list accounts of user %s: %s\n", identity.UserID, err)
+			failed = true
+			continue
+		}
+
+		for _, account := range accounts {
+			state, err := backfiller.BackfillAccount(ctx, api, identity.UserID, account)
+			if err != nil {
+				fmt.Printf(
+					"Could not backfill account %s of user %s after %d transactions: %s\n",
+					account.ID, identity.UserID, state.Transactions, err,
+				)
+				failed = true
+				continue
+			}
+
+			truncated := ""
+			if state.Truncated {
+				truncated = ", only the last 90 days were available"
+			}
+
+			fmt.Printf(
+				"Backfilled %d transactions of account %s of user %s up to %s%s\n",
+				state.Transactions, account.ID, identity.UserID,
+				state.Before.Format(time.RFC3339), truncated,
+			)
+		}
+	}
+
+	if failed {
+		ledger.Close()
+		os.Exit(1)
+	}
+}
+
+func serve() {
+	buckets, err := ParseTransactionAmountBuckets(*transactionAmountBuckets)
+	if err != nil {
+		fmt.Printf("Could not parse transaction amount buckets: %s\n", err)
+		os.Exit(1)
+	}
+	SetTransactionAmountBuckets(buckets)
+
+	RegisterCustomMetrics()
+	configureMonzoAPI()
+
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		fmt.Printf("Could not load timezone: %s\n", err)
+		os.Exit(1)
+	}
+	DayLocation = location
+
+	if *monthStartDay < 1 || *monthStartDay > 31 {
+		fmt.Printf("Month start day must be between 1 and 31, not %d\n", *monthStartDay)
+		os.Exit(1)
+	}
+	MonthStartDay = *monthStartDay
 
 	var usingMonzoAccessTokens func(func([]string) error) error
 	var monzoOAuthClient MonzoOAuthClient
@@ -55,8 +281,34 @@ func main() {
 		monzoOAuthClient.MonzoOAuthClientID = *monzoOAuthClientID
 		monzoOAuthClient.MonzoOAuthClientSecret = *monzoOAuthClientSecret
 		monzoOAuthClient.ExternalURL = *monzoOAuthExternalURL
+		monzoOAuthClient.AuthURL = *monzoAuthURL
 
-		usingMonzoAccessTokens = monzoOAuthClient.Start(*monzoOAuthPort)
+		tokenStoreKey, err := LoadTokenStoreKey(
+			*monzoOAuthTokenStoreKey, *monzoOAuthTokenStoreKeyFile,
+		)
+		if err != nil {
+			fmt.Printf("Could not load token store key: %s\n", err)
+			os.Exit(1)
+		}
+
+		tokenStore, err := NewMonzoTokenStore(
+			*monzoOAuthTokenStore, *monzoOAuthTokenStorePath, tokenStoreKey,
+		)
+		if err != nil {
+			fmt.Printf("Could not configure token store: %s\n", err)
+			os.Exit(1)
+		}
+		monzoOAuthClient.TokenStore = tokenStore
+
+		usingMonzoAccessTokens, err = monzoOAuthClient.Start(*monzoOAuthPort)
+		if err != nil {
+			// Nothing else is started, so the store is never saved over, but
+			// metrics are served so that the error can be alerted on
+			fmt.Printf("Could not load token store, only serving metrics: %s\n", err)
+			err = serveMetrics()
+			fmt.Printf("Could not serve metrics: %s\n", err)
+			os.Exit(1)
+		}
 	} else {
 		fmt.Println("One of the following options is required:")
 		fmt.Println("  - ONLY   --monzo-access-tokens")
@@ -64,16 +316,55 @@ func main() {
 		os.Exit(1)
 	}
 
-	RegisterCustomMetrics()
+	monzoTransactionStore, err := NewMonzoTransactionStore(
+		*transactionStore, *transactionStorePath,
+	)
+	if err != nil {
+		fmt.Printf("Could not configure transaction store: %s\n", err)
+		os.Exit(1)
+	}
 
-	supervisor := suture.NewSimple("MonzoCollector")
-	supervisor.Add(&MonzoCollector{
-		usingMonzoAccessTokens,
-		time.Duration(*metricsScrapeInterval) * time.Second,
-		make(chan bool),
-	})
-	defer supervisor.Stop()
-	supervisor.ServeBackground()
+	prometheus.MustRegister(
+		NewMonzoTransactionTotalsCollector(monzoTransactionStore),
+	)
+
+	monzoCollector := &MonzoCollector{
+		usingAccessTokens: usingMonzoAccessTokens,
+		transactions:      NewMonzoTransactionSyncer(monzoTransactionStore),
+		duration:          time.Duration(*metricsScrapeInterval) * time.Second,
+		concurrency:       *metricsCollectConcurrency,
+		stop:              make(chan bool),
+	}
+
+	// The memory store would download months of history again on every
+	// restart, synchronously within the first collection
+	if *transactionAutoBackfill && *transactionStore == TRANSACTION_STORE_LEDGER {
+		monzoCollector.backfiller = NewMonzoTransactionBackfiller(monzoTransactionStore)
+	}
+
+	if *metricsCollectOnScrape {
+		snapshotCollector := NewMonzoSnapshotCollector(
+			time.Duration(*metricsScrapeRefreshAge)*time.Second,
+			monzoCollector.CollectIfNeeded,
+		)
+		prometheus.MustRegister(snapshotCollector)
+		monzoCollector.publisher = snapshotCollector
+	} else {
+		RegisterSnapshotMetrics()
+		monzoCollector.publisher = NewGaugeSnapshotPublisher()
+	}
+
+	dailyReset, err := NewMonzoDailyReset(
+		*dailyResetSchedule, monzoCollector.publisher,
+	)
+	if err != nil {
+		fmt.Printf("Could not configure daily reset: %s\n", err)
+		os.Exit(1)
+	}
+
+	supervisor := suture.NewSimple("MonzoExporter")
+	supervisor.Add(monzoCollector)
+	supervisor.Add(dailyReset)
 
 	if *monzoAccessTokens != "" {
 		log.Println(
@@ -84,30 +375,20 @@ func main() {
 			"main: Skipping starting OAuth token refresher because interval is 0",
 		)
 	} else {
-		tickerOAuthInterval := time.NewTicker(
-			time.Duration(*monzoOAuthRefreshInterval) * time.Second,
-		)
-
-		go func() {
-			for range tickerOAuthInterval.C {
-				log.Println("main: Refreshing OAuth tokens")
-				err := monzoOAuthClient.RefreshAToken()
-				if err != nil {
-					log.Printf("main: Encountered error refreshing tokens")
-				}
-				log.Println("main: Refreshed OAuth tokens")
-			}
-		}()
+		supervisor.Add(NewMonzoTokenRefresher(
+			&monzoOAuthClient,
+			time.Duration(*monzoOAuthRefreshInterval)*time.Second,
+			time.Duration(*monzoOAuthRefreshLead)*time.Second,
+		))
 	}
 
-	log.Println("Registering cron handlers")
-	scheduler := cron.New()
-	scheduler.AddFunc(
-		"@midnight",
-		ResetTransactionsAmountToday,
-	)
-	log.Println("Registered cron handlers")
+	defer supervisor.Stop()
+	supervisor.ServeBackground()
+
+	serveMetrics()
+}
 
+func serveMetrics() error {
 	log.Printf("main: Serving prometheus on :%d", *metricsPort)
-	http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), promhttp.Handler())
+	return http.ListenAndServe(fmt.Sprintf(":%d", *metricsPort), promhttp.Handler())
 }
@@ -0,0 +1,327 @@
+// Package monzo is a client for the parts of the Monzo API used by the
+// exporter: https://docs.monzo.com
+package monzo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultBaseURL   = "https://api.monzo.com"
+	DefaultTimeout   = 30 * time.Second
+	DefaultUserAgent = "monzo-exporter"
+)
+
+type config struct {
+	baseURL    string
+	httpClient *http.Client
+	timeout    time.Duration
+	userAgent  string
+}
+
+type Option func(*config)
+
+// WithBaseURL talks to something other than the real Monzo API
+func WithBaseURL(baseURL string) Option {
+	return func(c *config) { c.baseURL = strings.TrimSuffix(baseURL, "/") }
+}
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *config) { c.httpClient = httpClient }
+}
+
+// WithTimeout limits each request, on top of any deadline of the context
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *config) { c.timeout = timeout }
+}
+
+func WithUserAgent(userAgent string) Option {
+	return func(c *config) { c.userAgent = userAgent }
+}
+
+func newConfig(options []Option) config {
+	c := config{
+		baseURL:    DefaultBaseURL,
+		httpClient: http.DefaultClient,
+		timeout:    DefaultTimeout,
+		userAgent:  DefaultUserAgent,
+	}
+
+	for _, option := range options {
+		option(&c)
+	}
+
+	return c
+}
+
+type endpointKey struct{}
+
+// Endpoint identifies the API call a request made by a Client is for, which
+// transports can use to label requests without knowing their query strings
+// or bodies, falling back to the request path
+func Endpoint(req *http.Request) string {
+	if endpoint, ok := req.Context().Value(endpointKey{}).(string); ok {
+		return endpoint
+	}
+	return req.URL.Path
+}
+
+// request is a single call to the Monzo API
+//
+// endpoint is how the call is identified in errors and by Endpoint
+type request struct {
+	method   string
+	path     string
+	endpoint string
+	query    url.Values
+	form     url.Values
+	token    string
+}
+
+func (c config) do(ctx context.Context, r request, into interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	requestURL := c.baseURL + r.path
+	if len(r.query) > 0 {
+		requestURL += "?" + r.query.Encode()
+	}
+
+	var body io.Reader
+	if r.form != nil {
+		body = strings.NewReader(r.form.Encode())
+	}
+
+	req, err := http.NewRequest(r.method, requestURL, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(context.WithValue(ctx, endpointKey{}, r.endpoint))
+
+	req.Header.Set("User-Agent", c.userAgent)
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	if r.form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s could not be requested => %w", r.endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s response could not be read => %w", r.endpoint, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newError(r.endpoint, resp.StatusCode, respBody)
+	}
+
+	if into == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(respBody, into)
+	if err != nil {
+		return fmt.Errorf("%s response could not be unmarshalled => %w", r.endpoint, err)
+	}
+
+	return nil
+}
+
+// Client makes requests to the Monzo API on behalf of a single user
+//
+// Methods return zero values alongside any error, so nothing from an
+// unsuccessful response can be mistaken for data
+type Client struct {
+	accessToken string
+	config      config
+}
+
+func NewClient(accessToken string, options ...Option) *Client {
+	return &Client{
+		accessToken: accessToken,
+		config:      newConfig(options),
+	}
+}
+
+func (c *Client) get(
+	ctx context.Context, path string, query url.Values, into interface{},
+) error {
+	return c.config.do(ctx, request{
+		method:   "GET",
+		path:     path,
+		endpoint: path,
+		query:    query,
+		token:    c.accessToken,
+	}, into)
+}
+
+func (c *Client) WhoAmI(ctx context.Context) (CallerIdentity, error) {
+	var callerID CallerIdentity
+	err := c.get(ctx, "/ping/whoami", nil, &callerID)
+	if err != nil {
+		return CallerIdentity{}, err
+	}
+	return callerID, nil
+}
+
+func (c *Client) ListAccounts(ctx context.Context) ([]Account, error) {
+	var accountsResp ListAccountsResponse
+	err := c.get(ctx, "/accounts", nil, &accountsResp)
+	if err != nil {
+		return nil, err
+	}
+	return accountsResp.Accounts, nil
+}
+
+func (c *Client) ListPots(ctx context.Context, accountID AccountID) ([]Pot, error) {
+	var potsResp ListPotsResponse
+	err := c.get(ctx, "/pots", url.Values{
+		"current_account_id": {string(accountID)},
+	}, &potsResp)
+	if err != nil {
+		return nil, err
+	}
+	return potsResp.Pots, nil
+}
+
+func (c *Client) GetBalance(ctx context.Context, accountID AccountID) (Balance, error) {
+	var balance Balance
+	err := c.get(ctx, "/balance", url.Values{
+		"account_id": {string(accountID)},
+	}, &balance)
+	if err != nil {
+		return Balance{}, err
+	}
+	return balance, nil
+}
+
+// ListTransactions lists transactions with merchants expanded
+func (c *Client) ListTransactions(
+	ctx context.Context, accountID AccountID, query TransactionsQuery,
+) ([]Transaction, error) {
+	values := url.Values{
+		"account_id": {string(accountID)},
+		"expand[]":   {"merchant"},
+	}
+
+	if query.SinceID != "" {
+		values.Set("since", string(query.SinceID))
+	} else if !query.Since.IsZero() {
+		values.Set("since", query.Since.UTC().Format(time.RFC3339))
+	}
+
+	if !query.Before.IsZero() {
+		values.Set("before", query.Before.UTC().Format(time.RFC3339))
+	}
+
+	if query.Limit > 0 {
+		values.Set("limit", strconv.Itoa(query.Limit))
+	}
+
+	var transactionsResp TransactionsResponse
+	err := c.get(ctx, "/transactions", values, &transactionsResp)
+	if err != nil {
+		return nil, err
+	}
+	return transactionsResp.Transactions, nil
+}
+
+// GetTransaction gets a single transaction with its merchant expanded
+func (c *Client) GetTransaction(
+	ctx context.Context, transactionID TransactionID,
+) (Transaction, error) {
+	var transactionResp TransactionResponse
+	err := c.config.do(ctx, request{
+		method:   "GET",
+		path:     "/transactions/" + url.PathEscape(string(transactionID)),
+		endpoint: "/transactions/:id",
+		query:    url.Values{"expand[]": {"merchant"}},
+		token:    c.accessToken,
+	}, &transactionResp)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return transactionResp.Transaction, nil
+}
+
+// Logout invalidates the access token
+func (c *Client) Logout(ctx context.Context) error {
+	return c.config.do(ctx, request{
+		method:   "POST",
+		path:     "/oauth2/logout",
+		endpoint: "/oauth2/logout",
+		token:    c.accessToken,
+	}, nil)
+}
+
+// OAuthClient gets tokens for users of an OAuth client
+type OAuthClient struct {
+	clientID     string
+	clientSecret string
+	config       config
+}
+
+func NewOAuthClient(clientID string, clientSecret string, options ...Option) *OAuthClient {
+	return &OAuthClient{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		config:       newConfig(options),
+	}
+}
+
+func (c *OAuthClient) token(
+	ctx context.Context, grantType string, form url.Values,
+) (AuthResponse, error) {
+	var authResponse AuthResponse
+
+	form.Set("grant_type", grantType)
+	form.Set("client_id", c.clientID)
+	form.Set("client_secret", c.clientSecret)
+
+	err := c.config.do(ctx, request{
+		method:   "POST",
+		path:     "/oauth2/token",
+		endpoint: "/oauth2/token?grant_type=" + grantType,
+		form:     form,
+	}, &authResponse)
+	if err != nil {
+		return AuthResponse{}, err
+	}
+	return authResponse, nil
+}
+
+// ExchangeAuthorizationCode finishes an OAuth journey
+func (c *OAuthClient) ExchangeAuthorizationCode(
+	ctx context.Context, redirectURI string, code string,
+) (AuthResponse, error) {
+	return c.token(ctx, "authorization_code", url.Values{
+		"redirect_uri": {redirectURI},
+		"code":         {code},
+	})
+}
+
+func (c *OAuthClient) RefreshToken(
+	ctx context.Context, refreshToken RefreshToken,
+) (AuthResponse, error) {
+	return c.token(ctx, "refresh_token", url.Values{
+		"refresh_token": {string(refreshToken)},
+	})
+}
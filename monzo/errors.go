@@ -0,0 +1,101 @@
+package monzo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error is returned when Monzo responds with a non-2xx status code
+//
+// Code and Message are parsed from Monzo's error response, and are empty when
+// the body was not JSON, for example when a proxy responded instead of Monzo
+type Error struct {
+	Endpoint   string
+	StatusCode int
+	Code       string
+	Message    string
+	Body       string
+}
+
+func newError(endpoint string, statusCode int, body []byte) *Error {
+	var errorResponse struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	// Not every error response is JSON, in which case only the body is kept
+	json.Unmarshal(body, &errorResponse)
+
+	return &Error{
+		Endpoint:   endpoint,
+		StatusCode: statusCode,
+		Code:       errorResponse.Code,
+		Message:    errorResponse.Message,
+		Body:       string(body),
+	}
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf(
+			"%s was not successful, status code => %d ; body => %s",
+			e.Endpoint, e.StatusCode, e.Body,
+		)
+	}
+
+	return fmt.Sprintf(
+		"%s was not successful, status code => %d ; code => %s ; message => %s",
+		e.Endpoint, e.StatusCode, e.Code, e.Message,
+	)
+}
+
+// IsRefreshTokenRejected is true when Monzo rejected the refresh token itself
+// because it has been revoked, has expired or has already been used
+//
+// Other rejections, such as bad client credentials, are not the fault of the
+// refresh token and may go away once the exporter is configured correctly
+func (e *Error) IsRefreshTokenRejected() bool {
+	if e.StatusCode != http.StatusBadRequest && !e.IsUnauthorized() {
+		return false
+	}
+
+	return strings.HasPrefix(e.Code, "unauthorized.bad_refresh_token") ||
+		e.Code == "invalid_grant" ||
+		strings.HasSuffix(e.Code, ".invalid_grant")
+}
+
+// IsUnauthorized is true when the access token is invalid or has expired
+func (e *Error) IsUnauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized
+}
+
+// IsForbidden is true when the credentials are valid but do not grant access,
+// which is the case until the user approves access in the Monzo app, and
+// again when strong customer authentication has to be renewed
+func (e *Error) IsForbidden() bool {
+	return e.StatusCode == http.StatusForbidden
+}
+
+// IsInsufficientPermissions is true when access has not been approved in the
+// Monzo app, as opposed to any other reason for being forbidden
+func (e *Error) IsInsufficientPermissions() bool {
+	return e.IsForbidden() &&
+		strings.HasPrefix(e.Code, "forbidden.insufficient_permissions")
+}
+
+// IsRateLimited is true when too many requests have been made
+func (e *Error) IsRateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+func (e *Error) IsNotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// IsServerError is true when the problem is Monzo's, so the request may
+// succeed if tried again later
+func (e *Error) IsServerError() bool {
+	return e.StatusCode >= 500
+}
@@ -0,0 +1,33 @@
+package monzo
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsRefreshTokenRejected(t *testing.T) {
+	cases := []struct {
+		statusCode int
+		code       string
+		rejected   bool
+	}{
+		{http.StatusUnauthorized, "unauthorized.bad_refresh_token", true},
+		{http.StatusUnauthorized, "unauthorized.bad_refresh_token.evicted", true},
+		{http.StatusBadRequest, "invalid_grant", true},
+		{http.StatusBadRequest, "bad_request.invalid_grant", true},
+		{http.StatusUnauthorized, "unauthorized.bad_client_credentials", false},
+		{http.StatusBadRequest, "bad_request.missing_param", false},
+		{http.StatusForbidden, "forbidden.insufficient_permissions", false},
+		{http.StatusInternalServerError, "invalid_grant", false},
+		{http.StatusUnauthorized, "", false},
+	}
+
+	for _, c := range cases {
+		err := &Error{StatusCode: c.statusCode, Code: c.code}
+		if err.IsRefreshTokenRejected() != c.rejected {
+			t.Errorf(
+				"expected %d %q to be rejected %t", c.statusCode, c.code, c.rejected,
+			)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package monzo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxRetries    = 3
+	DefaultMinBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff    = 30 * time.Second
+	DefaultMaxRetryAfter = time.Minute
+
+	RETRY_REASON_RATE_LIMITED    = "rate_limited"
+	RETRY_REASON_SERVER_ERROR    = "server_error"
+	RETRY_REASON_TRANSPORT_ERROR = "transport_error"
+
+	BUDGET_GLOBAL = "global"
+	BUDGET_TOKEN  = "token"
+)
+
+// ErrBudgetExhausted is returned instead of making a request which would go
+// over a RetryTransport's request budget
+var ErrBudgetExhausted = errors.New("request budget exhausted")
+
+// RetryTransport retries idempotent requests which were throttled or failed
+// because of Monzo, and limits how many requests are made
+//
+// Retries wait for the Retry-After header if Monzo sent one, otherwise for a
+// jittered exponential backoff. No retry waits past the request's deadline,
+// in which case the last response is returned as it is
+//
+// Budgets allow a number of requests per minute, shared by every request and
+// per access token. Requests over budget fail straight away rather than wait,
+// so that a backlog cannot build up behind a throttled user
+type RetryTransport struct {
+	// Base makes the requests, http.DefaultTransport if nil
+	Base http.RoundTripper
+
+	MaxRetries    int
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	MaxRetryAfter time.Duration
+
+	// OnRetry is called before waiting to retry a request
+	OnRetry func(endpoint string, reason string, wait time.Duration)
+	// OnBudgetExhausted is called when a request is over a budget
+	OnBudgetExhausted func(endpoint string, budget string)
+
+	globalBudget *requestBudget
+	tokenLimit   int
+
+	tokenBudgetsLock sync.Mutex
+	tokenBudgets     map[string]*requestBudget
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+// NewRetryTransport creates a RetryTransport with the default retry settings
+//
+// globalBudget and tokenBudget are requests per minute, 0 for no limit
+func NewRetryTransport(
+	base http.RoundTripper, globalBudget int, tokenBudget int,
+) *RetryTransport {
+	return &RetryTransport{
+		Base:          base,
+		MaxRetries:    DefaultMaxRetries,
+		MinBackoff:    DefaultMinBackoff,
+		MaxBackoff:    DefaultMaxBackoff,
+		MaxRetryAfter: DefaultMaxRetryAfter,
+
+		globalBudget: newRequestBudget(globalBudget, time.Minute),
+		tokenLimit:   tokenBudget,
+		tokenBudgets: make(map[string]*requestBudget),
+
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (t *RetryTransport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+func isIdempotent(req *http.Request) bool {
+	return req.Method == "GET" || req.Method == "HEAD"
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := Endpoint(req)
+
+	for attempt := 0; ; attempt++ {
+		err := t.spendBudget(req, endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base().RoundTrip(req)
+
+		if !isIdempotent(req) || attempt >= t.MaxRetries {
+			return resp, err
+		}
+
+		reason, wait, retry := t.shouldRetry(req.Context(), resp, err, attempt)
+		if !retry {
+			return resp, err
+		}
+
+		if deadline, ok := req.Context().Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return resp, err
+		}
+
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		if t.OnRetry != nil {
+			t.OnRetry(endpoint, reason, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (t *RetryTransport) shouldRetry(
+	ctx context.Context, resp *http.Response, err error, attempt int,
+) (string, time.Duration, bool) {
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", 0, false
+		}
+		return RETRY_REASON_TRANSPORT_ERROR, t.backoff(attempt), true
+	}
+
+	reason := ""
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		reason = RETRY_REASON_RATE_LIMITED
+	case resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		reason = RETRY_REASON_SERVER_ERROR
+	default:
+		return "", 0, false
+	}
+
+	if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		if wait > t.MaxRetryAfter {
+			return "", 0, false
+		}
+		return reason, wait, true
+	}
+
+	return reason, t.backoff(attempt), true
+}
+
+// backoff is between half and all of MinBackoff doubled for each attempt
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	backoff := t.MinBackoff
+	for i := 0; i < attempt && backoff < t.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > t.MaxBackoff {
+		backoff = t.MaxBackoff
+	}
+
+	if backoff <= 1 {
+		return backoff
+	}
+
+	t.randLock.Lock()
+	defer t.randLock.Unlock()
+
+	half := backoff / 2
+	return half + time.Duration(t.rand.Int63n(int64(backoff-half)))
+}
+
+// parseRetryAfter understands both delay seconds and HTTP dates
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		wait := date.Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
+func (t *RetryTransport) spendBudget(req *http.Request, endpoint string) error {
+	if !t.globalBudget.take(time.Now()) {
+		if t.OnBudgetExhausted != nil {
+			t.OnBudgetExhausted(endpoint, BUDGET_GLOBAL)
+		}
+		return fmt.Errorf("%s budget => %w", BUDGET_GLOBAL, ErrBudgetExhausted)
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" || t.tokenLimit <= 0 {
+		return nil
+	}
+
+	if !t.tokenBudget(authorization).take(time.Now()) {
+		if t.OnBudgetExhausted != nil {
+			t.OnBudgetExhausted(endpoint, BUDGET_TOKEN)
+		}
+		return fmt.Errorf("%s budget => %w", BUDGET_TOKEN, ErrBudgetExhausted)
+	}
+
+	return nil
+}
+
+// tokenBudget forgets budgets which have refilled, as they are the same as a
+// new budget, so that refreshed access tokens do not build up
+func (t *RetryTransport) tokenBudget(authorization string) *requestBudget {
+	t.tokenBudgetsLock.Lock()
+	defer t.tokenBudgetsLock.Unlock()
+
+	now := time.Now()
+	for key, budget := range t.tokenBudgets {
+		if key != authorization && budget.full(now) {
+			delete(t.tokenBudgets, key)
+		}
+	}
+
+	budget, ok := t.tokenBudgets[authorization]
+	if !ok {
+		budget = newRequestBudget(t.tokenLimit, time.Minute)
+		t.tokenBudgets[authorization] = budget
+	}
+	return budget
+}
+
+// requestBudget is a token bucket allowing limit requests per period, which
+// refills gradually, a nil requestBudget has no limit
+type requestBudget struct {
+	limit  float64
+	period time.Duration
+
+	lock      sync.Mutex
+	remaining float64
+	updated   time.Time
+}
+
+func newRequestBudget(limit int, period time.Duration) *requestBudget {
+	if limit <= 0 {
+		return nil
+	}
+
+	return &requestBudget{
+		limit:     float64(limit),
+		period:    period,
+		remaining: float64(limit),
+		updated:   time.Now(),
+	}
+}
+
+// refill must be called whilst holding the lock
+func (b *requestBudget) refill(now time.Time) {
+	elapsed := now.Sub(b.updated)
+	if elapsed <= 0 {
+		return
+	}
+
+	b.remaining += b.limit * float64(elapsed) / float64(b.period)
+	if b.remaining > b.limit {
+		b.remaining = b.limit
+	}
+	b.updated = now
+}
+
+func (b *requestBudget) take(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(now)
+	if b.remaining < 1 {
+		return false
+	}
+
+	b.remaining--
+	return true
+}
+
+func (b *requestBudget) full(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(now)
+	return b.remaining >= b.limit
+}
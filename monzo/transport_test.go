@@ -0,0 +1,225 @@
+package monzo
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respondWith serves each status code in turn, then 200 for the rest
+func respondWith(
+	t *testing.T, retryAfter string, statusCodes ...int,
+) (*httptest.Server, func() int) {
+	lock := sync.Mutex{}
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			defer lock.Unlock()
+
+			requests++
+			if requests > len(statusCodes) {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(statusCodes[requests-1])
+		},
+	))
+	t.Cleanup(server.Close)
+
+	return server, func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+func newTestRetryTransport(globalBudget int, tokenBudget int) *RetryTransport {
+	transport := NewRetryTransport(nil, globalBudget, tokenBudget)
+	transport.MinBackoff = time.Millisecond
+	transport.MaxBackoff = time.Millisecond
+	return transport
+}
+
+func doRequest(
+	t *testing.T, transport *RetryTransport, ctx context.Context,
+	method string, url string, token string,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestRetryTransportRetriesThrottledRequests(t *testing.T) {
+	server, requests := respondWith(t, "0",
+		http.StatusTooManyRequests, http.StatusServiceUnavailable,
+	)
+
+	transport := newTestRetryTransport(0, 0)
+	reasons := make([]string, 0)
+	transport.OnRetry = func(endpoint string, reason string, wait time.Duration) {
+		reasons = append(reasons, reason)
+	}
+
+	resp, err := doRequest(t, transport, context.Background(), "GET", server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || requests() != 3 {
+		t.Errorf("expected success on the 3rd request, got %d on %d", resp.StatusCode, requests())
+	}
+	if len(reasons) != 2 ||
+		reasons[0] != RETRY_REASON_RATE_LIMITED || reasons[1] != RETRY_REASON_SERVER_ERROR {
+		t.Errorf("expected a rate limited then a server error retry, got %v", reasons)
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	cases := map[string]struct {
+		method     string
+		retryAfter string
+		ctx        func() (context.Context, context.CancelFunc)
+		requests   int
+	}{
+		"after max retries": {
+			method: "GET", requests: DefaultMaxRetries + 1,
+		},
+		"when not idempotent": {
+			method: "POST", requests: 1,
+		},
+		"when retry after is too long": {
+			method: "GET", retryAfter: "3600", requests: 1,
+		},
+		"when retry after is past the deadline": {
+			method: "GET", retryAfter: "10", requests: 1,
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Second)
+			},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			statusCodes := make([]int, 10)
+			for i := range statusCodes {
+				statusCodes[i] = http.StatusServiceUnavailable
+			}
+			server, requests := respondWith(t, c.retryAfter, statusCodes...)
+
+			ctx, cancel := context.Background(), func() {}
+			if c.ctx != nil {
+				ctx, cancel = c.ctx()
+			}
+			defer cancel()
+
+			resp, err := doRequest(t, newTestRetryTransport(0, 0), ctx, c.method, server.URL, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != http.StatusServiceUnavailable || requests() != c.requests {
+				t.Errorf(
+					"expected the last response after %d requests, got %d after %d",
+					c.requests, resp.StatusCode, requests(),
+				)
+			}
+		})
+	}
+}
+
+func TestRetryTransportBudgets(t *testing.T) {
+	server, _ := respondWith(t, "")
+
+	transport := newTestRetryTransport(3, 1)
+	exhausted := make([]string, 0)
+	transport.OnBudgetExhausted = func(endpoint string, budget string) {
+		exhausted = append(exhausted, budget)
+	}
+
+	ctx := context.Background()
+
+	if _, err := doRequest(t, transport, ctx, "GET", server.URL, "token-1"); err != nil {
+		t.Fatalf("expected the first request to be within budget => %s", err)
+	}
+
+	_, err := doRequest(t, transport, ctx, "GET", server.URL, "token-1")
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("expected the token budget to be exhausted, got %v", err)
+	}
+
+	if _, err := doRequest(t, transport, ctx, "GET", server.URL, "token-2"); err != nil {
+		t.Errorf("expected another token to have its own budget => %s", err)
+	}
+
+	_, err = doRequest(t, transport, ctx, "GET", server.URL, "token-3")
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("expected the global budget to be exhausted, got %v", err)
+	}
+
+	if len(exhausted) != 2 || exhausted[0] != BUDGET_TOKEN || exhausted[1] != BUDGET_GLOBAL {
+		t.Errorf("expected the token then the global budget to run out, got %v", exhausted)
+	}
+}
+
+func TestRequestBudgetRefills(t *testing.T) {
+	budget := newRequestBudget(2, time.Minute)
+	now := budget.updated
+
+	if !budget.take(now) || !budget.take(now) || budget.take(now) {
+		t.Fatal("expected exactly 2 requests to be allowed")
+	}
+
+	if !budget.take(now.Add(30 * time.Second)) {
+		t.Error("expected half a minute to refill 1 request")
+	}
+
+	if !budget.full(now.Add(2 * time.Minute)) {
+		t.Error("expected the budget to be full again")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := map[string]struct {
+		wait time.Duration
+		ok   bool
+	}{
+		"":                              {0, false},
+		"120":                           {2 * time.Minute, true},
+		"-1":                            {0, false},
+		"soon":                          {0, false},
+		"Wed, 01 Jan 2020 12:00:30 GMT": {30 * time.Second, true},
+		"Wed, 01 Jan 2020 11:00:00 GMT": {0, true},
+	}
+
+	for value, expected := range cases {
+		wait, ok := parseRetryAfter(value, now)
+		if wait != expected.wait || ok != expected.ok {
+			t.Errorf(
+				"expected %q to be %s %t, got %s %t",
+				value, expected.wait, expected.ok, wait, ok,
+			)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package monzo
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type AccessToken string
+type AccountID string
+type ClientID string
+type Currency string
+type MerchantID string
+type PotID string
+type RefreshToken string
+type TransactionID string
+type UserID string
+
+type Account struct {
+	ID          AccountID `json:"id"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+}
+
+type Pot struct {
+	ID PotID `json:"id"`
+
+	Name string `json:"name"`
+
+	Currency Currency `json:"currency"`
+	Balance  int64    `json:"balance"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type ListAccountsResponse struct {
+	Accounts []Account `json:"accounts"`
+}
+
+type ListPotsResponse struct {
+	Pots []Pot `json:"pots"`
+}
+
+type Balance struct {
+	Balance      int64    `json:"balance"`
+	TotalBalance int64    `json:"total_balance"`
+	Currency     Currency `json:"currency"`
+	SpendToday   int64    `json:"spend_today"`
+}
+
+type CallerIdentity struct {
+	Authenticated bool     `json:"authenticated"`
+	ClientID      ClientID `json:"client_id"`
+	UserID        UserID   `json:"user_id"`
+}
+
+type AuthResponse struct {
+	AccessToken   AccessToken  `json:"access_token"`
+	RefreshToken  RefreshToken `json:"refresh_token"`
+	UserID        UserID       `json:"user_id"`
+	ExpirySeconds float64      `json:"expires_in"`
+}
+
+// Transaction is a transaction listed with its merchant expanded
+//
+// Amounts are in minor units, negative for money leaving the account, and
+// LocalAmount is in LocalCurrency for transactions made abroad
+type Transaction struct {
+	ID        TransactionID `json:"id"`
+	AccountID AccountID     `json:"account_id"`
+	UserID    UserID        `json:"user_id"`
+
+	Created OptionalTime `json:"created"`
+	Settled OptionalTime `json:"settled"`
+
+	Amount        int64    `json:"amount"`
+	Currency      Currency `json:"currency"`
+	LocalAmount   int64    `json:"local_amount"`
+	LocalCurrency Currency `json:"local_currency"`
+
+	Description string    `json:"description"`
+	Category    string    `json:"category"`
+	Merchant    *Merchant `json:"merchant"`
+	Notes       string    `json:"notes"`
+
+	DeclineReason     string `json:"decline_reason,omitempty"`
+	IsLoad            bool   `json:"is_load"`
+	IncludeInSpending bool   `json:"include_in_spending"`
+
+	Metadata     map[string]string `json:"metadata"`
+	Counterparty Counterparty      `json:"counterparty"`
+}
+
+// IsDeclined is true for card payments which were refused, which never move
+// any money
+func (t Transaction) IsDeclined() bool {
+	return t.DeclineReason != ""
+}
+
+// IsSpending is true for money leaving the account which Monzo counts as
+// spending, which leaves out declines and moving money into pots
+func (t Transaction) IsSpending() bool {
+	return t.Amount < 0 && t.IncludeInSpending && !t.IsDeclined()
+}
+
+// IsSettled is false until the transaction has been settled by the merchant,
+// up until when its amount can still change
+func (t Transaction) IsSettled() bool {
+	return !t.Settled.IsZero()
+}
+
+// Merchant is only fully filled in when expanded, otherwise Monzo lists just
+// its ID
+type Merchant struct {
+	ID       MerchantID `json:"id"`
+	GroupID  string     `json:"group_id"`
+	Name     string     `json:"name"`
+	Category string     `json:"category"`
+	Logo     string     `json:"logo"`
+	Emoji    string     `json:"emoji"`
+	Online   bool       `json:"online"`
+	ATM      bool       `json:"atm"`
+
+	Address  MerchantAddress   `json:"address"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func (m *Merchant) UnmarshalJSON(data []byte) error {
+	var id MerchantID
+	if err := json.Unmarshal(data, &id); err == nil {
+		*m = Merchant{ID: id}
+		return nil
+	}
+
+	// The alias has no UnmarshalJSON method, so this does not recurse
+	type merchant Merchant
+	return json.Unmarshal(data, (*merchant)(m))
+}
+
+type MerchantAddress struct {
+	ShortFormatted string  `json:"short_formatted"`
+	Formatted      string  `json:"formatted"`
+	Address        string  `json:"address"`
+	City           string  `json:"city"`
+	Region         string  `json:"region"`
+	Country        string  `json:"country"`
+	Postcode       string  `json:"postcode"`
+	Latitude       float64 `json:"latitude"`
+	Longitude      float64 `json:"longitude"`
+}
+
+// Counterparty is the other side of a bank transfer or payment between Monzo
+// users, and is empty for card payments
+type Counterparty struct {
+	AccountID     AccountID `json:"account_id,omitempty"`
+	UserID        UserID    `json:"user_id,omitempty"`
+	Name          string    `json:"name,omitempty"`
+	PreferredName string    `json:"preferred_name,omitempty"`
+	AccountNumber string    `json:"account_number,omitempty"`
+	SortCode      string    `json:"sort_code,omitempty"`
+}
+
+// OptionalTime is a time which Monzo leaves empty when it has not happened
+type OptionalTime struct {
+	time.Time
+}
+
+func (t *OptionalTime) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" || string(data) == `""` {
+		*t = OptionalTime{}
+		return nil
+	}
+
+	return t.Time.UnmarshalJSON(data)
+}
+
+func (t OptionalTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte(`""`), nil
+	}
+
+	return t.Time.MarshalJSON()
+}
+
+type TransactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+}
+
+type TransactionResponse struct {
+	Transaction Transaction `json:"transaction"`
+}
+
+// TransactionsQuery limits which transactions are listed, zero values are
+// left out of the request
+//
+// Transactions are listed oldest first. SinceID lists only transactions after
+// the given one, and takes precedence over Since, which makes it the cursor
+// for paging through transactions Limit at a time
+type TransactionsQuery struct {
+	Since   time.Time
+	SinceID TransactionID
+	Before  time.Time
+	Limit   int
+}
+
+// MaxTransactionsLimit is the most transactions Monzo lists in one request
+const MaxTransactionsLimit = 100
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tlwr/monzo-exporter/monzo"
+)
+
+const (
+	REQUEST_OUTCOME_SUCCESS      = "success"
+	REQUEST_OUTCOME_CLIENT_ERROR = "client_error"
+	REQUEST_OUTCOME_SERVER_ERROR = "server_error"
+	REQUEST_OUTCOME_ERROR        = "error"
+
+	TRANSPORT_ERROR_DNS        = "dns"
+	TRANSPORT_ERROR_TLS        = "tls"
+	TRANSPORT_ERROR_TIMEOUT    = "timeout"
+	TRANSPORT_ERROR_CANCELED   = "canceled"
+	TRANSPORT_ERROR_CONNECTION = "connection"
+	TRANSPORT_ERROR_OTHER      = "other"
+)
+
+// MonzoAPIInstrumentedTransport records metrics for every request made to the
+// Monzo API
+//
+// It sits underneath the monzo.RetryTransport, so each attempt at a request
+// is recorded, including those which are retried
+type MonzoAPIInstrumentedTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *MonzoAPIInstrumentedTransport) base() http.RoundTripper {
+	if t.Base == nil {
+		return http.DefaultTransport
+	}
+	return t.Base
+}
+
+func (t *MonzoAPIInstrumentedTransport) RoundTrip(
+	req *http.Request,
+) (*http.Response, error) {
+	endpoint := monzo.Endpoint(req)
+
+	IncMonzoAPIRequestsInFlight(endpoint)
+	defer DecMonzoAPIRequestsInFlight(endpoint)
+
+	start := time.Now()
+	resp, err := t.base().RoundTrip(req)
+	duration := time.Since(start)
+
+	if err != nil {
+		reason := classifyTransportError(err)
+		log.Printf(
+			"RoundTrip: Encountered %s error requesting %s => %s",
+			reason, endpoint, err,
+		)
+
+		ObserveMonzoAPIRequestDuration(endpoint, REQUEST_OUTCOME_ERROR, duration)
+		IncMonzoAPITransportErrors(endpoint, reason)
+		return resp, err
+	}
+
+	ObserveMonzoAPIRequestDuration(endpoint, requestOutcome(resp.StatusCode), duration)
+	IncMonzoAPIResponseCode(endpoint, resp.StatusCode)
+	return resp, nil
+}
+
+func requestOutcome(statusCode int) string {
+	switch {
+	case statusCode >= 500:
+		return REQUEST_OUTCOME_SERVER_ERROR
+	case statusCode >= 400:
+		return REQUEST_OUTCOME_CLIENT_ERROR
+	default:
+		return REQUEST_OUTCOME_SUCCESS
+	}
+}
+
+func classifyTransportError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return TRANSPORT_ERROR_DNS
+	}
+
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		hostnameErr         x509.HostnameError
+		certificateErr      x509.CertificateInvalidError
+		recordHeaderErr     tls.RecordHeaderError
+	)
+	if errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateErr) ||
+		errors.As(err, &recordHeaderErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return TRANSPORT_ERROR_TLS
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return TRANSPORT_ERROR_CANCELED
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return TRANSPORT_ERROR_TIMEOUT
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return TRANSPORT_ERROR_CONNECTION
+	}
+
+	return TRANSPORT_ERROR_OTHER
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// observedUserAuthStates holds the latest auth state seen for each user
+//
+// The TokensBox only knows whether a user's tokens can be refreshed, whereas
+// whether Monzo is still waiting for the user to approve access in their app
+// is only discovered when collecting metrics
+var observedUserAuthStates = struct {
+	sync.Mutex
+	states map[MonzoUserID]MonzoUserAuthState
+}{
+	states: make(map[MonzoUserID]MonzoUserAuthState),
+}
+
+func ObserveUserAuthState(userID MonzoUserID, state MonzoUserAuthState) {
+	observedUserAuthStates.Lock()
+	defer observedUserAuthStates.Unlock()
+
+	previous, ok := observedUserAuthStates.states[userID]
+	if ok && previous != state {
+		log.Printf(
+			"ObserveUserAuthState: User %s went from %s to %s",
+			userID, previous, state,
+		)
+	}
+
+	observedUserAuthStates.states[userID] = state
+	SetUserAuthState(userID, state)
+}
+
+func ObservedUserAuthState(userID MonzoUserID) (MonzoUserAuthState, bool) {
+	observedUserAuthStates.Lock()
+	defer observedUserAuthStates.Unlock()
+
+	state, ok := observedUserAuthStates.states[userID]
+	return state, ok
+}
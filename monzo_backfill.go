@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tlwr/monzo-exporter/monzo"
+)
+
+const (
+	// BACKFILL_LIMITED_HISTORY is how far back Monzo allows transactions to be
+	// listed once a few minutes have passed since the user authenticated, it
+	// is a day short of 90 days to allow for clock differences
+	BACKFILL_LIMITED_HISTORY = 89 * 24 * time.Hour
+)
+
+// MonzoTransactionBackfiller lists the history of an account into a
+// MonzoTransactionStore, from when the account was created up to where its
+// transactions were first synced
+//
+// Progress is saved after every page, so an interrupted backfill carries on
+// from where it stopped. Monzo only allows the full history to be listed
+// shortly after the user authenticates, after which the backfill falls back
+// to the last 90 days
+type MonzoTransactionBackfiller struct {
+	store    MonzoTransactionStore
+	pageSize int
+}
+
+func NewMonzoTransactionBackfiller(store MonzoTransactionStore) *MonzoTransactionBackfiller {
+	return &MonzoTransactionBackfiller{
+		store:    store,
+		pageSize: monzo.MaxTransactionsLimit,
+	}
+}
+
+func (b *MonzoTransactionBackfiller) BackfillAccount(
+	ctx context.Context,
+	api MonzoAPI,
+	userID MonzoUserID,
+	account MonzoAccount,
+) (MonzoAccountBackfillState, error) {
+	state, started, err := b.store.BackfillState(account.ID)
+	if err != nil {
+		return state, fmt.Errorf("could not load backfill state => %w", err)
+	}
+
+	if state.Complete {
+		SetBackfillComplete(userID, account.ID, true)
+		return state, nil
+	}
+
+	if !started {
+		syncState, synced, err := b.store.SyncState(account.ID)
+		if err != nil {
+			return state, fmt.Errorf("could not load sync state => %w", err)
+		}
+
+		state.Before = time.Now()
+		if synced && !syncState.SyncedFrom.IsZero() {
+			state.Before = syncState.SyncedFrom
+		}
+		state.From = account.Created
+
+		log.Printf(
+			"BackfillAccount: Starting backfill of user %s account %s up to %s",
+			userID, account.ID, state.Before,
+		)
+	}
+
+	SetBackfillComplete(userID, account.ID, false)
+
+	for {
+		query := MonzoTransactionsQuery{Before: state.Before, Limit: b.pageSize}
+		if state.Cursor != "" {
+			query.SinceID = state.Cursor
+		} else if !state.CursorCreated.IsZero() {
+			query.Since = state.CursorCreated
+		} else {
+			query.Since = account.Created
+		}
+
+		page, err := api.ListTransactions(ctx, account.ID, query)
+
+		var apiErr *MonzoAPIError
+		if errors.As(err, &apiErr) && apiErr.IsForbidden() && !state.Truncated {
+			state.Truncated = true
+			state.Cursor = ""
+			state.CursorCreated = time.Now().Add(-BACKFILL_LIMITED_HISTORY)
+			state.From = state.CursorCreated
+
+			log.Printf(
+				"BackfillAccount: Monzo no longer allows the full history of account %s, backfilling from %s",
+				account.ID, state.CursorCreated,
+			)
+			continue
+		}
+
+		if err != nil {
+			return state, err
+		}
+
+		for _, transaction := range page {
+			state.Cursor = transaction.ID
+			state.CursorCreated = transaction.Created.Time
+		}
+		state.Transactions += len(page)
+
+		if len(page) < b.pageSize {
+			state.Complete = true
+			state.CompletedAt = time.Now()
+		}
+
+		err = b.store.SaveBackfill(state, page)
+		if err != nil {
+			return state, fmt.Errorf("could not save transactions => %w", err)
+		}
+
+		AddBackfillTransactions(userID, account.ID, len(page))
+		if !state.CursorCreated.IsZero() {
+			SetBackfillProgress(userID, account.ID, state.CursorCreated)
+		}
+
+		log.Printf(
+			"BackfillAccount: Backfilled %d transactions of account %s up to %s",
+			state.Transactions, account.ID, state.CursorCreated,
+		)
+
+		if state.Complete {
+			break
+		}
+	}
+
+	SetBackfillComplete(userID, account.ID, true)
+	log.Printf(
+		"BackfillAccount: Completed backfill of user %s account %s with %d transactions",
+		userID, account.ID, state.Transactions,
+	)
+	return state, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tlwr/monzo-exporter/fakemonzo"
+)
+
+// failingTransactionsAPI fails listing transactions after a number of pages
+type failingTransactionsAPI struct {
+	MonzoAPI
+	pages int
+}
+
+func (a *failingTransactionsAPI) ListTransactions(
+	ctx context.Context, accountID MonzoAccountID, query MonzoTransactionsQuery,
+) ([]MonzoTransaction, error) {
+	if a.pages == 0 {
+		return nil, errors.New("connection reset")
+	}
+	a.pages--
+	return a.MonzoAPI.ListTransactions(ctx, accountID, query)
+}
+
+func newTestLedger(t *testing.T) *LedgerMonzoTransactionStore {
+	dir, err := ioutil.TempDir("", "monzo-exporter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := NewLedgerMonzoTransactionStore(filepath.Join(dir, "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		ledger.Close()
+		os.RemoveAll(dir)
+	})
+	return ledger
+}
+
+// startBackfillAccount serves an account with transactions created at each
+// of the given times, returning it as listed by Monzo
+func startBackfillAccount(
+	t *testing.T, created time.Time, transactions ...time.Time,
+) (*fakemonzo.Server, *fakemonzo.Account, MonzoAPI, MonzoAccount) {
+	account := &fakemonzo.Account{ID: "acc_backfill", Created: created}
+	for i, transactionCreated := range transactions {
+		account.Transactions = append(account.Transactions, fakeTransaction(
+			fmt.Sprintf("tx_%d", i+1), transactionCreated, true,
+		))
+	}
+
+	fake, _ := startFakeMonzo(t, fakemonzo.Fixtures{
+		Users: []*fakemonzo.User{{
+			UserID:      "user_backfill",
+			AccessToken: "token-backfill",
+			Approved:    true,
+			Accounts:    []*fakemonzo.Account{account},
+		}},
+	})
+
+	api := NewMonzoAPI("token-backfill")
+	accounts, err := api.ListAccounts(context.Background())
+	if err != nil || len(accounts) != 1 {
+		t.Fatalf("could not list the account => %v", err)
+	}
+
+	return fake, account, api, accounts[0]
+}
+
+func expectHistoryStart(
+	t *testing.T, syncer *MonzoTransactionSyncer, expected time.Time, when string,
+) {
+	start, err := syncer.HistoryStart("acc_backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !start.Equal(expected) {
+		t.Errorf("expected history to start at %s %s, got %s", expected, when, start)
+	}
+}
+
+func TestBackfillAccountResumesAfterFailure(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	created := now.AddDate(0, 0, -200)
+
+	fake, _, api, account := startBackfillAccount(t, created,
+		now.AddDate(0, 0, -150), now.AddDate(0, 0, -120), now.AddDate(0, 0, -60),
+		now.AddDate(0, 0, -30), now.AddDate(0, 0, -10),
+	)
+
+	ledger := newTestLedger(t)
+	syncer := NewMonzoTransactionSyncer(ledger)
+	backfiller := NewMonzoTransactionBackfiller(ledger)
+	backfiller.pageSize = 2
+
+	ctx := context.Background()
+	syncedFrom := now.Add(-time.Hour)
+
+	_, err := syncer.SyncAccount(ctx, api, "user_backfill", "acc_backfill", syncedFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second page fails, after the first was saved
+	state, err := backfiller.BackfillAccount(
+		ctx, &failingTransactionsAPI{MonzoAPI: api, pages: 1}, "user_backfill", account,
+	)
+	if err == nil {
+		t.Fatal("expected the backfill to fail")
+	}
+	if state.Complete || state.Cursor != "tx_2" || state.Transactions != 2 {
+		t.Errorf("expected the backfill to stop after tx_2, got %+v", state)
+	}
+	if !state.Before.Equal(syncedFrom) {
+		t.Errorf("expected the backfill to stop where the sync started, got %s", state.Before)
+	}
+	expectHistoryStart(t, syncer, syncedFrom, "whilst the backfill is incomplete")
+
+	requests := fake.Requests("/transactions")
+
+	state, err = backfiller.BackfillAccount(ctx, api, "user_backfill", account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !state.Complete || state.Truncated || state.Transactions != 5 {
+		t.Errorf("expected the backfill to complete with 5 transactions, got %+v", state)
+	}
+	if listed := fake.Requests("/transactions") - requests; listed != 2 {
+		t.Errorf("expected the backfill to carry on from tx_2 in 2 pages, got %d", listed)
+	}
+	expectHistoryStart(t, syncer, account.Created, "once the backfill is complete")
+
+	stored, err := ledger.TransactionsSince("acc_backfill", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 5 {
+		t.Errorf("expected 5 stored transactions, got %d", len(stored))
+	}
+}
+
+func TestBackfillAccountFallsBackToLimitedHistory(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	fake, _, api, account := startBackfillAccount(t, now.AddDate(-2, 0, 0),
+		now.AddDate(-1, 0, 0), now.AddDate(0, 0, -30),
+	)
+
+	ledger := newTestLedger(t)
+	syncer := NewMonzoTransactionSyncer(ledger)
+	backfiller := NewMonzoTransactionBackfiller(ledger)
+
+	ctx := context.Background()
+
+	_, err := syncer.SyncAccount(ctx, api, "user_backfill", "acc_backfill", now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Monzo forbids listing the full history once the user signed in more than
+	// a few minutes ago
+	fake.InjectError("/transactions", fakemonzo.InjectedError{
+		StatusCode: 403,
+		Code:       "forbidden.verification_required",
+		Message:    "Verification required",
+		Times:      1,
+	})
+
+	state, err := backfiller.BackfillAccount(ctx, api, "user_backfill", account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limitedFrom := now.Add(-BACKFILL_LIMITED_HISTORY)
+	if !state.Complete || !state.Truncated || state.Transactions != 1 ||
+		state.From.Before(limitedFrom) || state.From.After(limitedFrom.Add(time.Minute)) {
+		t.Errorf("expected only the last 89 days to be backfilled, got %+v", state)
+	}
+	expectHistoryStart(t, syncer, state.From, "from the limited history")
+}
+
+func TestFirstSyncCarriesOnFromBackfill(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	fake, account, api, monzoAccount := startBackfillAccount(t, now.AddDate(0, 0, -20),
+		now.AddDate(0, 0, -10),
+	)
+
+	ledger := newTestLedger(t)
+	syncer := NewMonzoTransactionSyncer(ledger)
+	backfiller := NewMonzoTransactionBackfiller(ledger)
+
+	ctx := context.Background()
+
+	// The backfill command runs before the exporter ever synced the account
+	state, err := backfiller.BackfillAccount(ctx, api, "user_backfill", monzoAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Update(func(fixtures *fakemonzo.Fixtures) {
+		account.Transactions = append(account.Transactions, fakeTransaction(
+			"tx_gap", state.Before.Add(time.Second), true,
+		))
+	})
+
+	// The exporter first syncs the account on a later day
+	_, err = syncer.SyncAccount(
+		ctx, api, "user_backfill", "acc_backfill", state.Before.Add(time.Hour),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncState, _, _ := ledger.SyncState("acc_backfill")
+	if !syncState.SyncedFrom.Equal(state.Before) {
+		t.Errorf("expected the first sync to start where the backfill stopped, got %s", syncState.SyncedFrom)
+	}
+
+	stored, err := ledger.TransactionsSince("acc_backfill", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 || stored[1].ID != "tx_gap" {
+		t.Errorf("expected the transaction between the backfill and the sync, got %d", len(stored))
+	}
+	expectHistoryStart(t, syncer, monzoAccount.Created, "once the gap is synced")
+}
+
+func TestHistoryStart(t *testing.T) {
+	now := time.Now()
+	syncedFrom := now.Add(-time.Hour)
+	created := now.AddDate(-1, 0, 0)
+
+	syncState := &MonzoAccountSyncState{SyncedFrom: syncedFrom}
+
+	cases := map[string]struct {
+		backfill *MonzoAccountBackfillState
+		expected time.Time
+	}{
+		"without a backfill": {nil, syncedFrom},
+		"whilst backfilling": {
+			&MonzoAccountBackfillState{From: created, Before: syncedFrom},
+			syncedFrom,
+		},
+		"once backfilled": {
+			&MonzoAccountBackfillState{From: created, Before: syncedFrom, Complete: true},
+			created,
+		},
+		"with a gap before the first sync": {
+			&MonzoAccountBackfillState{From: created, Before: syncedFrom.Add(-time.Hour), Complete: true},
+			syncedFrom,
+		},
+		"truncated before From was kept": {
+			&MonzoAccountBackfillState{Before: syncedFrom, Truncated: true, Complete: true, CompletedAt: now},
+			now.Add(-BACKFILL_LIMITED_HISTORY),
+		},
+	}
+
+	for name, c := range cases {
+		start, synced := historyStart(syncState, c.backfill)
+		if !synced || !start.Equal(c.expected) {
+			t.Errorf("expected history %s to start at %s, got %s", name, c.expected, start)
+		}
+	}
+
+	if _, synced := historyStart(nil, nil); synced {
+		t.Error("expected an account which was never synced to have no history")
+	}
+}
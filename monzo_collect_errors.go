@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	COLLECT_STAGE_IDENTITY     = "identity"
+	COLLECT_STAGE_ACCOUNTS     = "accounts"
+	COLLECT_STAGE_BALANCE      = "balance"
+	COLLECT_STAGE_TRANSACTIONS = "transactions"
+	COLLECT_STAGE_POTS         = "pots"
+	COLLECT_STAGE_BACKFILL     = "backfill"
+
+	UNKNOWN_USER_ID = "unknown"
+)
+
+// MonzoCollectError is a failure to collect one stage for one user, which does
+// not stop collection for other stages, accounts, or users
+type MonzoCollectError struct {
+	UserID    MonzoUserID
+	AccountID MonzoAccountID
+	Stage     string
+	Err       error
+}
+
+// NewMonzoCollectError logs and counts the error before returning it
+func NewMonzoCollectError(
+	userID MonzoUserID, accountID MonzoAccountID, stage string, err error,
+) *MonzoCollectError {
+	if userID == "" {
+		userID = UNKNOWN_USER_ID
+	}
+
+	collectErr := &MonzoCollectError{userID, accountID, stage, err}
+	log.Printf("NewMonzoCollectError: %s", collectErr)
+
+	IncCollectErrors(userID, stage)
+	return collectErr
+}
+
+func (e *MonzoCollectError) Error() string {
+	if e.AccountID == "" {
+		return fmt.Sprintf("user %s stage %s => %s", e.UserID, e.Stage, e.Err)
+	}
+
+	return fmt.Sprintf(
+		"user %s account %s stage %s => %s",
+		e.UserID, e.AccountID, e.Stage, e.Err,
+	)
+}
+
+func (e *MonzoCollectError) Unwrap() error {
+	return e.Err
+}
+
+// MonzoCollectErrors summarises every error from a collection cycle
+type MonzoCollectErrors []*MonzoCollectError
+
+func (e MonzoCollectErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+
+	return fmt.Sprintf(
+		"%d collection errors: %s", len(e), strings.Join(messages, " ; "),
+	)
+}
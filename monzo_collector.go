@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 )
 
 type MonzoCollector struct {
 	usingAccessTokens func(func([]string) error) error
+	transactions      *MonzoTransactionSyncer
+	backfiller        *MonzoTransactionBackfiller
 	duration          time.Duration
+	concurrency       int
+	publisher         SnapshotPublisher
 	stop              chan bool
+
+	collectLock sync.Mutex
 }
 
 func (m *MonzoCollector) Stop() {
@@ -28,7 +37,7 @@ func (m *MonzoCollector) Serve() {
 			return
 		default:
 			log.Println("Serve: Starting metric collection")
-			err := m.usingAccessTokens(CollectAllMetrics)
+			err := m.CollectNow()
 			log.Println("Serve: Finished metric collection")
 
 			if err != nil {
@@ -41,147 +50,507 @@ func (m *MonzoCollector) Serve() {
 	}
 }
 
-func CollectAllMetrics(accessTokens []string) error {
-	log.Printf("CollectAllMetrics: Starting for %d tokens", len(accessTokens))
+// CollectNow runs a collection cycle, waiting for any cycle already running
+func (m *MonzoCollector) CollectNow() error {
+	return m.CollectIfNeeded(func() bool { return true })
+}
+
+// CollectIfNeeded waits for any cycle already running, then runs a collection
+// cycle only if needed still returns true, so that callers who were waiting
+// for the same cycle do not each run another
+func (m *MonzoCollector) CollectIfNeeded(needed func() bool) error {
+	m.collectLock.Lock()
+	defer m.collectLock.Unlock()
 
-	for i, token := range accessTokens {
-		log.Printf("CollectAllMetrics: Doing token %d of %d",
-			i+1, len(accessTokens),
+	if !needed() {
+		log.Println("CollectIfNeeded: Collected whilst waiting, skipping")
+		return nil
+	}
+
+	return m.usingAccessTokens(func(accessTokens []string) error {
+		return CollectAllMetrics(
+			context.Background(), accessTokens,
+			m.concurrency, m.transactions, m.backfiller, m.publisher,
 		)
+	})
+}
 
-		identity, err := GetUserIdentity(token)
-		if err != nil {
-			return err
-		}
+// collectPool runs collection jobs with bounded concurrency
+//
+// Jobs may add further jobs, but must not wait for them, otherwise the pool
+// could fill up with jobs waiting for jobs which cannot start
+type collectPool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
 
-		SetUserLatestCollect(identity.UserID)
+	errorsLock sync.Mutex
+	errors     []*MonzoCollectError
+}
 
-		err = CollectAccountMetrics(token, identity)
-		if err != nil {
-			return err
-		}
+func newCollectPool(concurrency int) *collectPool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
 
-		err = CollectPotMetrics(token, identity)
-		if err != nil {
-			return err
-		}
+	return &collectPool{
+		slots:  make(chan struct{}, concurrency),
+		errors: make([]*MonzoCollectError, 0),
+	}
+}
+
+func (p *collectPool) Go(job func()) {
+	p.wg.Add(1)
+
+	go func() {
+		defer p.wg.Done()
+
+		p.slots <- struct{}{}
+		defer func() { <-p.slots }()
+
+		job()
+	}()
+}
+
+func (p *collectPool) Wait() {
+	p.wg.Wait()
+}
+
+func (p *collectPool) addErrors(collectErrors ...*MonzoCollectError) {
+	p.errorsLock.Lock()
+	defer p.errorsLock.Unlock()
+
+	p.errors = append(p.errors, collectErrors...)
+}
+
+// CollectAllMetrics collects every user and account concurrently, then
+// publishes what was collected all at once when the cycle is finished
+func CollectAllMetrics(
+	ctx context.Context,
+	accessTokens []string,
+	concurrency int,
+	transactions *MonzoTransactionSyncer,
+	backfiller *MonzoTransactionBackfiller,
+	publisher SnapshotPublisher,
+) error {
+	log.Printf(
+		"CollectAllMetrics: Starting for %d tokens with concurrency %d",
+		len(accessTokens), concurrency,
+	)
+
+	collectedAt := time.Now()
+	pool := newCollectPool(concurrency)
+	syncs := newCycleAccountSyncs(transactions, backfiller)
+
+	snapshotsLock := sync.Mutex{}
+	snapshots := make([]*MonzoUserSnapshot, 0)
+
+	for i, token := range accessTokens {
+		i, token := i, token
+
+		pool.Go(func() {
+			log.Printf("CollectAllMetrics: Doing token %d of %d",
+				i+1, len(accessTokens),
+			)
+
+			snapshot := collectUser(ctx, pool, syncs, NewMonzoAPI(token))
+			if snapshot == nil {
+				return
+			}
+
+			snapshotsLock.Lock()
+			snapshots = append(snapshots, snapshot)
+			snapshotsLock.Unlock()
+		})
+	}
+
+	pool.Wait()
+
+	cycle := MonzoCollectCycle{
+		CollectedAt: collectedAt,
+		Snapshots:   snapshots,
+		FailedUsers: make([]MonzoUserID, 0),
+	}
 
-		log.Printf("CollectAllMetrics: Done for user => %s", identity.UserID)
+	for _, collectErr := range pool.errors {
+		switch collectErr.Stage {
+		case COLLECT_STAGE_IDENTITY:
+			cycle.Unidentified++
+		case COLLECT_STAGE_ACCOUNTS:
+			cycle.FailedUsers = append(cycle.FailedUsers, collectErr.UserID)
+		}
 	}
 
-	log.Printf("CollectAllMetrics: Done %d tokens", len(accessTokens))
+	publisher.Publish(cycle)
+
+	log.Printf(
+		"CollectAllMetrics: Done %d tokens with %d errors",
+		len(accessTokens), len(pool.errors),
+	)
+
+	if len(pool.errors) > 0 {
+		return MonzoCollectErrors(pool.errors)
+	}
 	return nil
 }
 
-func CollectAccountMetrics(accessToken string, identity MonzoCallerIdentity) error {
-	log.Printf("CollectAccountMetrics: Starting user %s", identity.UserID)
-
-	accounts, err := ListAccounts(accessToken)
+// collectUser returns a snapshot which is filled in by account jobs added to
+// the pool, so it is only complete once the pool is finished
+func collectUser(
+	ctx context.Context,
+	pool *collectPool,
+	syncs *cycleAccountSyncs,
+	api MonzoAPI,
+) *MonzoUserSnapshot {
+	identity, err := api.WhoAmI(ctx)
+	if err != nil {
+		pool.addErrors(NewMonzoCollectError(
+			"", "", COLLECT_STAGE_IDENTITY, err,
+		))
+		return nil
+	}
 
+	accounts, approved, err := CheckUserApproval(ctx, api, identity)
 	if err != nil {
-		log.Printf(
-			"CollectAccountMetrics: Encountered error listing accounts for user %s => %s",
-			identity.UserID, err,
-		)
-		return err
+		pool.addErrors(NewMonzoCollectError(
+			identity.UserID, "", COLLECT_STAGE_ACCOUNTS, err,
+		))
+		return nil
 	}
 
-	for _, account := range accounts {
-		log.Printf(
-			"CollectAccountMetrics: Getting balance for user %s", identity.UserID,
-		)
+	if !approved {
+		return nil
+	}
+
+	snapshot := &MonzoUserSnapshot{
+		UserID:      identity.UserID,
+		CollectedAt: time.Now(),
+		Accounts:    make([]*MonzoAccountSnapshot, len(accounts)),
+	}
 
-		balance, err := GetBalance(accessToken, account.ID)
+	for i, account := range accounts {
+		i, account := i, account
 
-		if err != nil {
-			log.Printf(
-				"CollectAccountMetrics: Encountered error getting balance for user %s => %s",
-				identity.UserID, err,
+		pool.Go(func() {
+			accountSnapshot, collectErrors := CollectAccountSnapshot(
+				ctx, api, syncs, identity, account,
 			)
-			return err
-		}
 
-		SetCurrentBalance(identity.UserID, account.ID, balance.Balance)
-		SetTotalBalance(identity.UserID, account.ID, balance.TotalBalance)
-		SetSpendToday(identity.UserID, account.ID, balance.SpendToday)
+			// Each job has its own index, so no lock is needed
+			snapshot.Accounts[i] = accountSnapshot
+			pool.addErrors(collectErrors...)
+		})
+	}
+
+	log.Printf(
+		"collectUser: Queued %d accounts for user => %s",
+		len(accounts), identity.UserID,
+	)
+	return snapshot
+}
 
+// CheckUserApproval is a cheap request which fails until the user has approved
+// access in the Monzo app, during which time nothing else can be collected
+//
+// Being forbidden for any other reason is an error listing accounts
+func CheckUserApproval(
+	ctx context.Context, api MonzoAPI, identity MonzoCallerIdentity,
+) ([]MonzoAccount, bool, error) {
+	accounts, err := api.ListAccounts(ctx)
+
+	var apiErr *MonzoAPIError
+	if errors.As(err, &apiErr) && apiErr.IsInsufficientPermissions() {
 		log.Printf(
-			"CollectAccountMetrics: Getting transactions for user %s", identity.UserID,
+			"CheckUserApproval: User %s has not approved access in the Monzo app",
+			identity.UserID,
 		)
+		ObserveUserAuthState(identity.UserID, USER_AUTH_STATE_PENDING_APPROVAL)
+		return accounts, false, nil
+	}
 
-		transactions, err := GetTransactionsSinceDay(
-			accessToken, account.ID, time.Now(),
+	if err != nil {
+		log.Printf(
+			"CheckUserApproval: Encountered error listing accounts for user %s => %s",
+			identity.UserID, err,
 		)
+		return accounts, false, err
+	}
 
-		if err != nil {
-			log.Printf(
-				"CollectAccountMetrics: Encountered error getting transactions for user %s => %s",
-				identity.UserID, err,
-			)
-			return err
+	ObserveUserAuthState(identity.UserID, USER_AUTH_STATE_ACTIVE)
+	return accounts, true, nil
+}
+
+func CollectAccountSnapshot(
+	ctx context.Context,
+	api MonzoAPI,
+	syncs *cycleAccountSyncs,
+	identity MonzoCallerIdentity,
+	account MonzoAccount,
+) (*MonzoAccountSnapshot, []*MonzoCollectError) {
+	log.Printf(
+		"CollectAccountSnapshot: Starting user %s account %s",
+		identity.UserID, account.ID,
+	)
+
+	snapshot := &MonzoAccountSnapshot{AccountID: account.ID}
+	collectErrors := make([]*MonzoCollectError, 0)
+
+	balance, err := api.GetBalance(ctx, account.ID)
+
+	if err != nil {
+		collectErrors = append(collectErrors, NewMonzoCollectError(
+			identity.UserID, account.ID, COLLECT_STAGE_BALANCE, err,
+		))
+	} else {
+		snapshot.Balance = &balance
+	}
+
+	now := time.Now()
+	startOfDay := StartOfDay(now)
+	windows := SpendWindows(now)
+
+	// The first sync looks back as far as transactions are checked whilst
+	// pending, so that those made before today which are still pending are
+	// found
+	synced, ranSync := syncs.sync(
+		ctx, api, identity.UserID, account,
+		StartOfDay(now.Add(-TRANSACTION_PENDING_MAX_AGE)),
+		earliestSpendWindow(windows),
+	)
+
+	// Errors are only reported by the user whose job synced the account
+	if synced.err != nil {
+		if ranSync {
+			collectErrors = append(collectErrors, NewMonzoCollectError(
+				identity.UserID, account.ID, COLLECT_STAGE_TRANSACTIONS, synced.err,
+			))
 		}
+	} else {
+		snapshot.TransactionSummaries = SummariseTransactions(
+			transactionsSince(synced.transactions, startOfDay),
+		)
+		snapshot.SpendWindows = SummariseSpendWindows(
+			CoveredSpendWindows(windows, synced.historyStart),
+			synced.transactions,
+		)
+		snapshot.Settlement = SummariseSettlement(
+			transactionsSince(synced.transactions, startOfDay), synced.pending,
+		)
+	}
 
-		summaries := make(map[string]MonzoTransactionsSummary, 0)
-		for _, transaction := range transactions {
-			summaryKey := fmt.Sprintf(
-				"%s/%s",
-				transaction.Category, transaction.Description,
-			)
+	if ranSync && synced.backfillErr != nil {
+		collectErrors = append(collectErrors, NewMonzoCollectError(
+			identity.UserID, account.ID, COLLECT_STAGE_BACKFILL, synced.backfillErr,
+		))
+	}
 
-			if _, ok := summaries[summaryKey]; !ok {
-				summaries[summaryKey] = MonzoTransactionsSummary{
-					Amount:      transaction.Amount,
-					Category:    transaction.Category,
-					Description: transaction.Description,
-				}
-			} else {
-				summaries[summaryKey] = MonzoTransactionsSummary{
-					Amount:      summaries[summaryKey].Amount + transaction.Amount,
-					Category:    transaction.Category,
-					Description: transaction.Description,
-				}
-			}
+	pots, err := api.ListPots(ctx, account.ID)
+
+	if err != nil {
+		collectErrors = append(collectErrors, NewMonzoCollectError(
+			identity.UserID, account.ID, COLLECT_STAGE_POTS, err,
+		))
+	} else {
+		snapshot.Pots = pots
+	}
+
+	log.Printf(
+		"CollectAccountSnapshot: Done user %s account %s with %d errors",
+		identity.UserID, account.ID, len(collectErrors),
+	)
+	return snapshot, collectErrors
+}
+
+// accountSync is what syncing and backfilling an account found, which is
+// shared by every user who can see the account
+type accountSync struct {
+	once sync.Once
+
+	transactions []MonzoTransaction
+	pending      []MonzoTransaction
+	historyStart time.Time
+	err          error
+	backfillErr  error
+}
+
+// cycleAccountSyncs syncs and backfills each account once per cycle, however
+// many users can see it, so that jobs for the users of a joint account never
+// sync the same stored state at the same time
+type cycleAccountSyncs struct {
+	syncer     *MonzoTransactionSyncer
+	backfiller *MonzoTransactionBackfiller
+
+	lock     sync.Mutex
+	accounts map[MonzoAccountID]*accountSync
+}
+
+func newCycleAccountSyncs(
+	syncer *MonzoTransactionSyncer,
+	backfiller *MonzoTransactionBackfiller,
+) *cycleAccountSyncs {
+	return &cycleAccountSyncs{
+		syncer:     syncer,
+		backfiller: backfiller,
+		accounts:   make(map[MonzoAccountID]*accountSync),
+	}
+}
+
+// sync syncs the account, from initialSince if it has never been synced, then
+// lists what is stored since listSince and backfills it
+//
+// Only the first call for an account in a cycle does anything, and it returns
+// true. Later calls wait for it to finish, which cannot deadlock the pool as
+// the job doing the work is already running
+func (s *cycleAccountSyncs) sync(
+	ctx context.Context,
+	api MonzoAPI,
+	userID MonzoUserID,
+	account MonzoAccount,
+	initialSince time.Time,
+	listSince time.Time,
+) (*accountSync, bool) {
+	s.lock.Lock()
+	synced, ok := s.accounts[account.ID]
+	if !ok {
+		synced = &accountSync{}
+		s.accounts[account.ID] = synced
+	}
+	s.lock.Unlock()
+
+	ran := false
+	synced.once.Do(func() {
+		ran = true
+
+		owner, err := s.syncTransactions(
+			ctx, api, userID, account.ID, initialSince, listSince, synced,
+		)
+		synced.err = err
+		if owner == "" {
+			owner = userID
 		}
 
-		for _, summary := range summaries {
-			SetTransactionsAmountToday(identity.UserID, account.ID, summary)
+		// Backfilling comes after syncing, so it knows where the sync started
+		if s.backfiller != nil {
+			_, synced.backfillErr = s.backfiller.BackfillAccount(
+				ctx, api, owner, account,
+			)
 		}
-	}
+	})
 
-	log.Printf("CollectAccountMetrics: Done user %s", identity.UserID)
-	return nil
+	return synced, ran
 }
 
-func CollectPotMetrics(accessToken string, identity MonzoCallerIdentity) error {
-	log.Printf("CollectPotMetrics: Starting user %s", identity.UserID)
+// syncTransactions fills in what was synced, returning the owner of the
+// account
+func (s *cycleAccountSyncs) syncTransactions(
+	ctx context.Context,
+	api MonzoAPI,
+	userID MonzoUserID,
+	accountID MonzoAccountID,
+	initialSince time.Time,
+	listSince time.Time,
+	synced *accountSync,
+) (MonzoUserID, error) {
+	result, err := s.syncer.SyncAccount(ctx, api, userID, accountID, initialSince)
+	if err != nil {
+		return result.UserID, err
+	}
 
-	accounts, err := ListAccounts(accessToken)
+	synced.transactions, err = s.syncer.TransactionsSince(accountID, listSince)
+	if err != nil {
+		return result.UserID, err
+	}
 
+	synced.pending, err = s.syncer.PendingTransactions(accountID)
 	if err != nil {
-		log.Printf(
-			"CollectPotMetrics: Encountered error listing accounts for user %s => %s",
-			identity.UserID, err,
-		)
-		return err
+		return result.UserID, err
 	}
 
-	for _, account := range accounts {
-		pots, err := ListPots(accessToken, account.ID)
+	synced.historyStart, err = s.syncer.HistoryStart(accountID)
+	return result.UserID, err
+}
 
-		if err != nil {
-			log.Printf(
-				"CollectPotMetrics: Encountered error listing pots for user %s => %s",
-				identity.UserID, err,
-			)
-			return err
+// transactionsSince filters transactions which are listed oldest first
+func transactionsSince(
+	transactions []MonzoTransaction, since time.Time,
+) []MonzoTransaction {
+	for i, transaction := range transactions {
+		if !transaction.Created.Before(since) {
+			return transactions[i:]
 		}
+	}
+	return make([]MonzoTransaction, 0)
+}
 
-		for _, pot := range pots {
-			SetPotBalance(identity.UserID, pot.ID, pot.Name, pot.Balance)
+// SummariseSettlement adds up the pending transactions of any day, and those
+// made today which have settled, leaving out the same transactions as
+// SummariseTransactions
+func SummariseSettlement(
+	today []MonzoTransaction,
+	pending []MonzoTransaction,
+) *MonzoSettlementSummary {
+	summary := &MonzoSettlementSummary{}
+
+	for _, transaction := range pending {
+		if transaction.Amount < 0 && !transaction.IsSpending() {
+			continue
 		}
 
-		log.Printf("CollectPotMetrics: Done user %s", identity.UserID)
+		summary.PendingTransactions++
+		summary.PendingAmount += transaction.Amount
+
+		if summary.OldestPending.IsZero() ||
+			transaction.Created.Before(summary.OldestPending) {
+			summary.OldestPending = transaction.Created.Time
+		}
 	}
 
-	return nil
+	for _, transaction := range today {
+		if !transaction.IsSettled() || transaction.IsDeclined() ||
+			(transaction.Amount < 0 && !transaction.IsSpending()) {
+			continue
+		}
+		summary.SettledAmountToday += transaction.Amount
+	}
+
+	return summary
+}
+
+// SummariseTransactions adds up the amounts of transactions with the same
+// category and description, leaving out declined transactions and money
+// leaving the account which Monzo does not include in spending
+func SummariseTransactions(
+	transactions []MonzoTransaction,
+) []MonzoTransactionsSummary {
+	summaries := make(map[string]MonzoTransactionsSummary, 0)
+	for _, transaction := range transactions {
+		if transaction.IsDeclined() ||
+			(transaction.Amount < 0 && !transaction.IsSpending()) {
+			continue
+		}
+
+		summaryKey := fmt.Sprintf(
+			"%s/%s",
+			transaction.Category, transaction.Description,
+		)
+
+		if _, ok := summaries[summaryKey]; !ok {
+			summaries[summaryKey] = MonzoTransactionsSummary{
+				Amount:      transaction.Amount,
+				Category:    transaction.Category,
+				Description: transaction.Description,
+			}
+		} else {
+			summaries[summaryKey] = MonzoTransactionsSummary{
+				Amount:      summaries[summaryKey].Amount + transaction.Amount,
+				Category:    transaction.Category,
+				Description: transaction.Description,
+			}
+		}
+	}
+
+	summaryList := make([]MonzoTransactionsSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		summaryList = append(summaryList, summary)
+	}
+	return summaryList
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummariseSettlement(t *testing.T) {
+	now := time.Now()
+
+	potDeposit := testTransaction("tx_pot", now.Add(-time.Hour), -1000, false)
+	potDeposit.IncludeInSpending = false
+
+	declined := testTransaction("tx_declined", now, -300, true)
+	declined.DeclineReason = "INSUFFICIENT_FUNDS"
+
+	settledPotDeposit := testTransaction("tx_settled_pot", now, -700, true)
+	settledPotDeposit.IncludeInSpending = false
+
+	pending := []MonzoTransaction{
+		testTransaction("tx_stuck", now.AddDate(0, 0, -3), -1200, false),
+		testTransaction("tx_pending", now, -50, false),
+		potDeposit,
+	}
+	today := []MonzoTransaction{
+		testTransaction("tx_pending", now, -50, false),
+		testTransaction("tx_settled", now, -250, true),
+		testTransaction("tx_income", now, 5000, true),
+		declined,
+		settledPotDeposit,
+	}
+
+	summary := SummariseSettlement(today, pending)
+
+	if summary.PendingTransactions != 2 || summary.PendingAmount != -1250 {
+		t.Errorf(
+			"expected 2 pending transactions of -1250, got %d of %d",
+			summary.PendingTransactions, summary.PendingAmount,
+		)
+	}
+	if !summary.OldestPending.Equal(pending[0].Created.Time) {
+		t.Errorf("expected the oldest pending to be tx_stuck, got %s", summary.OldestPending)
+	}
+	if summary.SettledAmountToday != 4750 {
+		t.Errorf("expected 4750 settled today, got %d", summary.SettledAmountToday)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// DayLocation is the timezone in which days start and end
+var DayLocation = time.UTC
+
+// StartOfDay is midnight at the start of the day of t in DayLocation, which
+// is not always 24 hours before the next midnight
+func StartOfDay(t time.Time) time.Time {
+	year, month, day := t.In(DayLocation).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, DayLocation)
+}
+
+// MonzoDailyReset clears the amounts transacted today from the published
+// snapshots on a cron schedule in DayLocation
+//
+// Without it, the amounts of the previous day would be served until the next
+// collection, or for as long as collecting transactions keeps failing
+type MonzoDailyReset struct {
+	spec      string
+	schedule  cron.Schedule
+	publisher SnapshotPublisher
+	stop      chan bool
+}
+
+func NewMonzoDailyReset(
+	spec string,
+	publisher SnapshotPublisher,
+) (*MonzoDailyReset, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse reset schedule %s => %s", spec, err)
+	}
+
+	SetDailyResetInfo(spec, DayLocation)
+
+	return &MonzoDailyReset{
+		spec:      spec,
+		schedule:  schedule,
+		publisher: publisher,
+		stop:      make(chan bool),
+	}, nil
+}
+
+func (r *MonzoDailyReset) Stop() {
+	log.Println("Stop: Stopping MonzoDailyReset")
+	r.stop <- true
+}
+
+func (r *MonzoDailyReset) Serve() {
+	log.Printf("Serve: Starting MonzoDailyReset on schedule %s", r.spec)
+
+	for {
+		next := r.schedule.Next(time.Now().In(DayLocation))
+		SetDailyResetNext(next)
+		log.Printf("Serve: Next daily reset at %s", next)
+
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-r.stop:
+			timer.Stop()
+			log.Println("Serve: Stopped MonzoDailyReset")
+			return
+		case <-timer.C:
+		}
+
+		r.Reset(time.Now())
+	}
+}
+
+func (r *MonzoDailyReset) Reset(now time.Time) {
+	log.Println("Reset: Resetting amounts transacted today")
+	r.publisher.ResetDay()
+	SetDailyResetLast(now)
+	log.Println("Reset: Reset amounts transacted today")
+}
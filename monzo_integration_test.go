@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tlwr/monzo-exporter/fakemonzo"
+)
+
+const (
+	testClientID     = "fake-client-id"
+	testClientSecret = "fake-client-secret"
+)
+
+// startFakeMonzo serves fixtures and points the exporter at them until the
+// test finishes
+func startFakeMonzo(t *testing.T, fixtures fakemonzo.Fixtures) (*fakemonzo.Server, string) {
+	fixtures.ClientID = testClientID
+	fixtures.ClientSecret = testClientSecret
+
+	fake := fakemonzo.NewServer(fixtures)
+	server := httptest.NewServer(fake)
+
+	previousEndpoint := MonzoAPIEndpoint
+	MonzoAPIEndpoint = server.URL
+
+	t.Cleanup(func() {
+		MonzoAPIEndpoint = previousEndpoint
+		server.Close()
+	})
+
+	return fake, server.URL
+}
+
+func newTestTokenStore(t *testing.T) *FileMonzoTokenStore {
+	dir, err := ioutil.TempDir("", "monzo-exporter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return &FileMonzoTokenStore{
+		Path: filepath.Join(dir, "tokens.json"),
+		Key:  bytes.Repeat([]byte{7}, 32),
+	}
+}
+
+func startTestOAuthClient(
+	t *testing.T, fakeURL string, store MonzoTokenStore,
+) (*MonzoOAuthClient, string) {
+	client := &MonzoOAuthClient{
+		MonzoOAuthClientID:     testClientID,
+		MonzoOAuthClientSecret: testClientSecret,
+		AuthURL:                fakeURL + fakemonzo.AUTH_PATH,
+		TokenStore:             store,
+	}
+
+	server := httptest.NewServer(client)
+	t.Cleanup(server.Close)
+	client.ExternalURL = server.URL
+
+	_, err := client.Start(0)
+	if err != nil {
+		t.Fatalf("could not start OAuth client => %s", err)
+	}
+
+	return client, server.URL
+}
+
+func fakeUserTokens(fake *fakemonzo.Server, userID string) (string, string) {
+	var accessToken, refreshToken string
+
+	fake.Update(func(fixtures *fakemonzo.Fixtures) {
+		for _, user := range fixtures.Users {
+			if user.UserID == userID {
+				accessToken, refreshToken = user.AccessToken, user.RefreshToken
+			}
+		}
+	})
+
+	return accessToken, refreshToken
+}
+
+func tokensFor(
+	tokens []MonzoAccessAndRefreshTokens, userID MonzoUserID,
+) (MonzoAccessAndRefreshTokens, bool) {
+	for _, token := range tokens {
+		if token.UserID == userID {
+			return token, true
+		}
+	}
+	return MonzoAccessAndRefreshTokens{}, false
+}
+
+func TestOAuthJourneyStoresTokens(t *testing.T) {
+	fake, fakeURL := startFakeMonzo(t, fakemonzo.Fixtures{
+		AuthorizeAs: "user_journey",
+		Users:       []*fakemonzo.User{{UserID: "user_journey", Approved: true}},
+	})
+
+	store := newTestTokenStore(t)
+	client, oauthURL := startTestOAuthClient(t, fakeURL, store)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := (&http.Client{Jar: jar}).Get(oauthURL + START_PATH)
+	if err != nil {
+		t.Fatalf("could not complete the OAuth journey => %s", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("expected the callback to respond 201, got %d", response.StatusCode)
+	}
+
+	accessToken, refreshToken := fakeUserTokens(fake, "user_journey")
+
+	tokens, ok := tokensFor(client.CurrentTokens(), "user_journey")
+	if !ok {
+		t.Fatal("expected tokens for user_journey")
+	}
+	if string(tokens.AccessToken) != accessToken ||
+		string(tokens.RefreshToken) != refreshToken {
+		t.Errorf("expected the tokens issued by Monzo, got %+v", tokens)
+	}
+
+	state, _ := ObservedUserAuthState("user_journey")
+	if state != USER_AUTH_STATE_PENDING_APPROVAL {
+		t.Errorf("expected the user to be pending approval, got %s", state)
+	}
+
+	// Only the browser which completed the journey is shown the user's state
+	for name, c := range map[string]struct {
+		client *http.Client
+		shown  bool
+	}{
+		"journey browser": {&http.Client{Jar: jar}, true},
+		"other browser":   {&http.Client{}, false},
+	} {
+		status, err := c.client.Get(oauthURL + STATUS_PATH)
+		if err != nil {
+			t.Fatalf("could not get the status page => %s", err)
+		}
+		body, err := ioutil.ReadAll(status.Body)
+		status.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bytes.Contains(body, []byte("user_journey")) != c.shown {
+			t.Errorf("expected the %s to be shown user_journey %t", name, c.shown)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(store.Path)
+	if err != nil {
+		t.Fatalf("expected the tokens to be persisted => %s", err)
+	}
+	if bytes.Contains(contents, []byte(accessToken)) {
+		t.Error("expected the persisted tokens to be encrypted")
+	}
+
+	reloaded, err := (&FileMonzoTokenStore{Path: store.Path, Key: store.Key}).Load()
+	if err != nil {
+		t.Fatalf("could not reload the token store => %s", err)
+	}
+
+	stored, ok := tokensFor(reloaded, "user_journey")
+	if !ok || string(stored.AccessToken) != accessToken {
+		t.Errorf("expected the reloaded store to hold the new tokens, got %+v", reloaded)
+	}
+}
+
+func TestRefreshDueTokens(t *testing.T) {
+	fake, fakeURL := startFakeMonzo(t, fakemonzo.Fixtures{
+		Users: []*fakemonzo.User{{
+			UserID:       "user_refresh",
+			AccessToken:  "access-1",
+			RefreshToken: "refresh-1",
+			Approved:     true,
+		}},
+	})
+
+	now := time.Now()
+
+	store := newTestTokenStore(t)
+	err := store.Save([]MonzoAccessAndRefreshTokens{{
+		AccessToken:  "access-1",
+		RefreshToken: "refresh-1",
+		UserID:       "user_refresh",
+		ExpiryTime:   now.Add(time.Minute),
+		AuthState:    USER_AUTH_STATE_ACTIVE,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := startTestOAuthClient(t, fakeURL, store)
+	refresher := NewMonzoTokenRefresher(client, time.Minute, 10*time.Minute)
+
+	// Bad client credentials are not the fault of the refresh token
+	fake.InjectError("/oauth2/token", fakemonzo.InjectedError{
+		StatusCode: http.StatusUnauthorized,
+		Code:       "unauthorized.bad_client_credentials",
+		Message:    "Client credentials are invalid",
+		Times:      1,
+	})
+
+	refresher.RefreshDueTokens(now)
+
+	tokens, _ := tokensFor(client.CurrentTokens(), "user_refresh")
+	if tokens.AuthState != USER_AUTH_STATE_ACTIVE || tokens.AccessToken != "access-1" {
+		t.Fatalf("expected a failed refresh to leave the tokens alone, got %+v", tokens)
+	}
+
+	refresher.RefreshDueTokens(now)
+	if requests := fake.Requests("/oauth2/token"); requests != 1 {
+		t.Fatalf("expected no retry before the backoff, got %d requests", requests)
+	}
+
+	refresher.RefreshDueTokens(now.Add(TOKEN_REFRESH_MIN_BACKOFF))
+
+	accessToken, _ := fakeUserTokens(fake, "user_refresh")
+	tokens, _ = tokensFor(client.CurrentTokens(), "user_refresh")
+	if string(tokens.AccessToken) != accessToken {
+		t.Fatalf("expected the refreshed access token, got %+v", tokens)
+	}
+
+	stored, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedTokens, _ := tokensFor(stored, "user_refresh"); string(storedTokens.AccessToken) != accessToken {
+		t.Errorf("expected the refreshed tokens to be persisted, got %+v", storedTokens)
+	}
+
+	// A rejected refresh token can only be fixed by signing in again
+	fake.InjectError("/oauth2/token", fakemonzo.InjectedError{
+		StatusCode: http.StatusUnauthorized,
+		Code:       "unauthorized.bad_refresh_token",
+		Message:    "Refresh token is invalid",
+		Times:      1,
+	})
+
+	refresher.RefreshDueTokens(tokens.ExpiryTime)
+
+	tokens, _ = tokensFor(client.CurrentTokens(), "user_refresh")
+	if tokens.AuthState != USER_AUTH_STATE_NEEDS_REAUTHENTICATION {
+		t.Errorf("expected the user to need reauthentication, got %s", tokens.AuthState)
+	}
+
+	stored, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedTokens, _ := tokensFor(stored, "user_refresh"); storedTokens.AuthState != USER_AUTH_STATE_NEEDS_REAUTHENTICATION {
+		t.Errorf("expected the auth state to be persisted, got %s", storedTokens.AuthState)
+	}
+}
+
+type recordingPublisher struct {
+	cycles []MonzoCollectCycle
+}
+
+func (p *recordingPublisher) Publish(cycle MonzoCollectCycle) {
+	p.cycles = append(p.cycles, cycle)
+}
+
+func (p *recordingPublisher) ResetDay() {}
+
+func snapshotFor(cycle MonzoCollectCycle, userID MonzoUserID) *MonzoUserSnapshot {
+	for _, snapshot := range cycle.Snapshots {
+		if snapshot.UserID == userID {
+			return snapshot
+		}
+	}
+	return nil
+}
+
+func accountSnapshotFor(
+	snapshot *MonzoUserSnapshot, accountID MonzoAccountID,
+) *MonzoAccountSnapshot {
+	for _, account := range snapshot.Accounts {
+		if account.AccountID == accountID {
+			return account
+		}
+	}
+	return nil
+}
+
+func TestCollectAllMetrics(t *testing.T) {
+	store := NewInMemoryMonzoTransactionStore()
+	created := time.Now().UTC()
+
+	joint := &fakemonzo.Account{
+		ID:      "acc_joint",
+		Created: created.AddDate(-1, 0, 0),
+		Balance: fakemonzo.Balance{Currency: "GBP"},
+		Transactions: []fakemonzo.Transaction{{
+			"id":                  "tx_stuck",
+			"created":             created.AddDate(0, 0, -3).Format(time.RFC3339Nano),
+			"amount":              -1200,
+			"currency":            "GBP",
+			"category":            "holidays",
+			"description":         "HOTEL",
+			"include_in_spending": true,
+		}, {
+			"id":                  "tx_joint",
+			"created":             created.Format(time.RFC3339Nano),
+			"settled":             created.Format(time.RFC3339Nano),
+			"amount":              -450,
+			"currency":            "GBP",
+			"category":            "groceries",
+			"description":         "SUPERMARKET",
+			"include_in_spending": true,
+		}},
+	}
+
+	fake, _ := startFakeMonzo(t, fakemonzo.Fixtures{
+		Users: []*fakemonzo.User{
+			{
+				UserID:      "user_approved",
+				AccessToken: "token-approved",
+				Approved:    true,
+				Accounts: []*fakemonzo.Account{
+					{ID: "acc_own", Created: created.AddDate(-1, 0, 0)},
+					joint,
+				},
+			},
+			{
+				UserID:      "user_joint",
+				AccessToken: "token-joint",
+				Approved:    true,
+				Accounts:    []*fakemonzo.Account{joint},
+			},
+			{
+				UserID:      "user_pending",
+				AccessToken: "token-pending",
+				Approved:    false,
+			},
+		},
+	})
+
+	publisher := &recordingPublisher{}
+
+	err := CollectAllMetrics(
+		context.Background(),
+		[]string{"token-approved", "token-joint", "token-pending", "token-unknown"},
+		2, NewMonzoTransactionSyncer(store), nil, publisher,
+	)
+
+	var collectErrors MonzoCollectErrors
+	if !errors.As(err, &collectErrors) || len(collectErrors) != 1 ||
+		collectErrors[0].Stage != COLLECT_STAGE_IDENTITY {
+		t.Fatalf("expected only the unknown token to fail, got %v", err)
+	}
+
+	if len(publisher.cycles) != 1 {
+		t.Fatalf("expected one published cycle, got %d", len(publisher.cycles))
+	}
+	cycle := publisher.cycles[0]
+
+	if cycle.Unidentified != 1 {
+		t.Errorf("expected 1 unidentified token, got %d", cycle.Unidentified)
+	}
+	if len(cycle.Snapshots) != 2 || snapshotFor(cycle, "user_pending") != nil {
+		t.Errorf("expected snapshots for the approved users only, got %d", len(cycle.Snapshots))
+	}
+
+	if state, _ := ObservedUserAuthState("user_pending"); state != USER_AUTH_STATE_PENDING_APPROVAL {
+		t.Errorf("expected user_pending to be pending approval, got %s", state)
+	}
+	if state, _ := ObservedUserAuthState("user_approved"); state != USER_AUTH_STATE_ACTIVE {
+		t.Errorf("expected user_approved to be active, got %s", state)
+	}
+
+	// The joint account is synced once, and shared by both users
+	if requests := fake.Requests("/transactions"); requests != 2 {
+		t.Errorf("expected each account to be synced once, got %d requests", requests)
+	}
+
+	for _, userID := range []MonzoUserID{"user_approved", "user_joint"} {
+		snapshot := snapshotFor(cycle, userID)
+		if snapshot == nil {
+			t.Fatalf("expected a snapshot for %s", userID)
+		}
+
+		account := accountSnapshotFor(snapshot, "acc_joint")
+		if account == nil || len(account.TransactionSummaries) != 1 ||
+			account.TransactionSummaries[0].Amount != -450 {
+			t.Errorf("expected %s to see today's joint transaction, got %+v", userID, account)
+		}
+
+		// A transaction from an earlier day which is still pending is found by
+		// the first sync
+		if account == nil || account.Settlement == nil ||
+			account.Settlement.PendingTransactions != 1 ||
+			account.Settlement.PendingAmount != -1200 {
+			t.Errorf("expected %s to see the pending joint transaction, got %+v", userID, account)
+		}
+	}
+
+	totals, err := store.Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals[0].Spend != 450 {
+		t.Errorf("expected the joint spend to be counted once, got %+v", totals)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// LEDGER_KEY_TIME_FORMAT sorts in time order, unlike RFC3339Nano which
+	// leaves off trailing zeros
+	LEDGER_KEY_TIME_FORMAT = "2006-01-02T15:04:05.000000000Z"
+
+	LEDGER_OPEN_TIMEOUT = 5 * time.Second
+)
+
+var (
+	ledgerTransactionsBucket = []byte("transactions")
+	ledgerAccountsBucket     = []byte("accounts")
+	ledgerCreatedBucket      = []byte("created")
+	ledgerSyncStateKey       = []byte("sync_state")
+	ledgerBackfillStateKey   = []byte("backfill_state")
+	ledgerTotalsKey          = []byte("totals")
+	ledgerDeclinesKey        = []byte("declines")
+	ledgerMerchantsKey       = []byte("merchant_totals")
+)
+
+// MonzoLedgerEntry is a transaction as it is kept in a MonzoTransactionStore
+//
+// CountedAt is when the transaction was added to the totals of its account
+type MonzoLedgerEntry struct {
+	Transaction MonzoTransaction `json:"transaction"`
+	FirstSeen   time.Time        `json:"first_seen"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+	CountedAt   time.Time        `json:"counted_at,omitempty"`
+}
+
+// upsertLedgerEntry replaces the transaction of an existing entry, keeping
+// everything else about it
+func upsertLedgerEntry(
+	existing *MonzoLedgerEntry, transaction MonzoTransaction, now time.Time,
+) MonzoLedgerEntry {
+	if existing == nil {
+		return MonzoLedgerEntry{
+			Transaction: transaction,
+			FirstSeen:   now,
+			UpdatedAt:   now,
+		}
+	}
+
+	entry := *existing
+	entry.Transaction = transaction
+	entry.UpdatedAt = now
+	return entry
+}
+
+// LedgerMonzoTransactionStore keeps every transaction ever synced in a bbolt
+// database at Path
+//
+// Transactions are keyed by ID, and indexed per account by when they were
+// created. Each account's sync and backfill states are saved in the same
+// database transaction as the transactions they cover, as are the totals
+// of each account
+type LedgerMonzoTransactionStore struct {
+	Path string
+	db   *bolt.DB
+}
+
+func NewLedgerMonzoTransactionStore(path string) (*LedgerMonzoTransactionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: LEDGER_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, fmt.Errorf("could not open ledger %s => %s", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(ledgerTransactionsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(ledgerAccountsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not set up ledger %s => %s", path, err)
+	}
+
+	log.Printf("LedgerMonzoTransactionStore: Opened ledger %s", path)
+	return &LedgerMonzoTransactionStore{Path: path, db: db}, nil
+}
+
+func (s *LedgerMonzoTransactionStore) Close() error {
+	return s.db.Close()
+}
+
+func ledgerCreatedKey(transaction MonzoTransaction) []byte {
+	return []byte(
+		transaction.Created.UTC().Format(LEDGER_KEY_TIME_FORMAT) +
+			"/" + string(transaction.ID),
+	)
+}
+
+func (s *LedgerMonzoTransactionStore) SyncState(
+	accountID MonzoAccountID,
+) (MonzoAccountSyncState, bool, error) {
+	state := MonzoAccountSyncState{AccountID: accountID}
+
+	found, err := s.getState(accountID, ledgerSyncStateKey, &state)
+	if err != nil {
+		return state, false, fmt.Errorf(
+			"could not read sync state of account %s => %s", accountID, err,
+		)
+	}
+	return state, found, nil
+}
+
+func (s *LedgerMonzoTransactionStore) SaveSync(
+	state MonzoAccountSyncState, transactions []MonzoTransaction,
+) error {
+	return s.save(state.AccountID, ledgerSyncStateKey, state, transactions, &state)
+}
+
+func (s *LedgerMonzoTransactionStore) BackfillState(
+	accountID MonzoAccountID,
+) (MonzoAccountBackfillState, bool, error) {
+	state := MonzoAccountBackfillState{AccountID: accountID}
+
+	found, err := s.getState(accountID, ledgerBackfillStateKey, &state)
+	if err != nil {
+		return state, false, fmt.Errorf(
+			"could not read backfill state of account %s => %s", accountID, err,
+		)
+	}
+	return state, found, nil
+}
+
+func (s *LedgerMonzoTransactionStore) SaveBackfill(
+	state MonzoAccountBackfillState, transactions []MonzoTransaction,
+) error {
+	return s.save(state.AccountID, ledgerBackfillStateKey, state, transactions, nil)
+}
+
+func (s *LedgerMonzoTransactionStore) HistoryStart(
+	accountID MonzoAccountID,
+) (time.Time, bool, error) {
+	syncState, synced, err := s.SyncState(accountID)
+	if err != nil || !synced {
+		return time.Time{}, false, err
+	}
+
+	backfillState, backfilled, err := s.BackfillState(accountID)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if !backfilled {
+		start, _ := historyStart(&syncState, nil)
+		return start, true, nil
+	}
+
+	start, _ := historyStart(&syncState, &backfillState)
+	return start, true, nil
+}
+
+func (s *LedgerMonzoTransactionStore) getState(
+	accountID MonzoAccountID, key []byte, state interface{},
+) (bool, error) {
+	found := false
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		account := tx.Bucket(ledgerAccountsBucket).Bucket([]byte(accountID))
+		if account == nil {
+			return nil
+		}
+
+		contents := account.Get(key)
+		if contents == nil {
+			return nil
+		}
+
+		found = true
+		return json.Unmarshal(contents, state)
+	})
+
+	return found, err
+}
+
+// save upserts transactions and puts the state at key in one transaction,
+// counting the transactions when given the sync state
+func (s *LedgerMonzoTransactionStore) save(
+	accountID MonzoAccountID,
+	key []byte,
+	state interface{},
+	transactions []MonzoTransaction,
+	synced *MonzoAccountSyncState,
+) error {
+	now := time.Now()
+	counted := make([]MonzoTransaction, 0)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(ledgerTransactionsBucket)
+
+		account, err := tx.Bucket(ledgerAccountsBucket).CreateBucketIfNotExists(
+			[]byte(accountID),
+		)
+		if err != nil {
+			return err
+		}
+
+		created, err := account.CreateBucketIfNotExists(ledgerCreatedBucket)
+		if err != nil {
+			return err
+		}
+
+		totals := make(monzoTransactionTotals)
+		err = getLedgerValue(account, ledgerTotalsKey, &totals)
+		if err != nil {
+			return err
+		}
+
+		declines := make(monzoDeclineTotals)
+		err = getLedgerValue(account, ledgerDeclinesKey, &declines)
+		if err != nil {
+			return err
+		}
+
+		merchants := make(monzoMerchantTotals)
+		err = getLedgerValue(account, ledgerMerchantsKey, &merchants)
+		if err != nil {
+			return err
+		}
+
+		for _, transaction := range transactions {
+			existing, err := getLedgerEntry(entries, transaction.ID)
+			if err != nil {
+				return err
+			}
+
+			if existing != nil {
+				err = created.Delete(ledgerCreatedKey(existing.Transaction))
+				if err != nil {
+					return err
+				}
+			}
+
+			entry := upsertLedgerEntry(existing, transaction, now)
+
+			if synced != nil && countLedgerEntry(
+				&entry, *synced, synced.SyncedFrom,
+				totals, declines, merchants, now,
+			) {
+				counted = append(counted, transaction)
+			}
+
+			contents, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+
+			err = entries.Put([]byte(transaction.ID), contents)
+			if err != nil {
+				return err
+			}
+
+			err = created.Put(ledgerCreatedKey(transaction), []byte(transaction.ID))
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(counted) > 0 {
+			err = putLedgerValue(account, ledgerTotalsKey, totals)
+			if err != nil {
+				return err
+			}
+
+			err = putLedgerValue(account, ledgerDeclinesKey, declines)
+			if err != nil {
+				return err
+			}
+
+			err = putLedgerValue(account, ledgerMerchantsKey, merchants)
+			if err != nil {
+				return err
+			}
+		}
+
+		contents, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		return account.Put(key, contents)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Only once the transaction has been committed, so nothing is observed
+	// which could be counted again
+	for _, transaction := range counted {
+		ObserveCountedTransaction(synced.UserID, synced.AccountID, transaction)
+	}
+	return nil
+}
+
+// getLedgerValue leaves value as it is when there is nothing at key
+func getLedgerValue(bucket *bolt.Bucket, key []byte, value interface{}) error {
+	contents := bucket.Get(key)
+	if contents == nil {
+		return nil
+	}
+
+	err := json.Unmarshal(contents, value)
+	if err != nil {
+		return fmt.Errorf("could not unmarshal %s => %s", key, err)
+	}
+	return nil
+}
+
+func putLedgerValue(bucket *bolt.Bucket, key []byte, value interface{}) error {
+	contents, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, contents)
+}
+
+func getLedgerEntry(
+	entries *bolt.Bucket, id MonzoTransactionID,
+) (*MonzoLedgerEntry, error) {
+	contents := entries.Get([]byte(id))
+	if contents == nil {
+		return nil, nil
+	}
+
+	var entry MonzoLedgerEntry
+	err := json.Unmarshal(contents, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal transaction %s => %s", id, err)
+	}
+	return &entry, nil
+}
+
+func (s *LedgerMonzoTransactionStore) TransactionsSince(
+	accountID MonzoAccountID, since time.Time,
+) ([]MonzoTransaction, error) {
+	transactions := make([]MonzoTransaction, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(ledgerTransactionsBucket)
+
+		account := tx.Bucket(ledgerAccountsBucket).Bucket([]byte(accountID))
+		if account == nil {
+			return nil
+		}
+
+		created := account.Bucket(ledgerCreatedBucket)
+		if created == nil {
+			return nil
+		}
+
+		start := []byte(since.UTC().Format(LEDGER_KEY_TIME_FORMAT))
+		cursor := created.Cursor()
+
+		for key, id := cursor.Seek(start); key != nil; key, id = cursor.Next() {
+			entry, err := getLedgerEntry(entries, MonzoTransactionID(id))
+			if err != nil {
+				return err
+			}
+
+			if entry != nil {
+				transactions = append(transactions, entry.Transaction)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return transactions, fmt.Errorf(
+			"could not list transactions of account %s => %s", accountID, err,
+		)
+	}
+	return transactions, nil
+}
+
+func (s *LedgerMonzoTransactionStore) Totals() ([]MonzoTransactionTotal, error) {
+	totals := make([]MonzoTransactionTotal, 0)
+
+	err := s.forEachAccount(func(account *bolt.Bucket) error {
+		accountTotals := make(monzoTransactionTotals)
+		err := getLedgerValue(account, ledgerTotalsKey, &accountTotals)
+		if err != nil {
+			return err
+		}
+
+		totals = append(totals, accountTotals.list()...)
+		return nil
+	})
+
+	if err != nil {
+		return totals, fmt.Errorf("could not list totals => %s", err)
+	}
+	return totals, nil
+}
+
+func (s *LedgerMonzoTransactionStore) MerchantTotals() ([]MonzoMerchantTotal, error) {
+	merchants := make([]MonzoMerchantTotal, 0)
+
+	err := s.forEachAccount(func(account *bolt.Bucket) error {
+		accountMerchants := make(monzoMerchantTotals)
+		err := getLedgerValue(account, ledgerMerchantsKey, &accountMerchants)
+		if err != nil {
+			return err
+		}
+
+		merchants = append(merchants, accountMerchants.list()...)
+		return nil
+	})
+
+	if err != nil {
+		return merchants, fmt.Errorf("could not list merchant totals => %s", err)
+	}
+	return merchants, nil
+}
+
+func (s *LedgerMonzoTransactionStore) Declines() ([]MonzoDeclineTotal, error) {
+	declines := make([]MonzoDeclineTotal, 0)
+
+	err := s.forEachAccount(func(account *bolt.Bucket) error {
+		accountDeclines := make(monzoDeclineTotals)
+		err := getLedgerValue(account, ledgerDeclinesKey, &accountDeclines)
+		if err != nil {
+			return err
+		}
+
+		declines = append(declines, accountDeclines.list()...)
+		return nil
+	})
+
+	if err != nil {
+		return declines, fmt.Errorf("could not list decline totals => %s", err)
+	}
+	return declines, nil
+}
+
+func (s *LedgerMonzoTransactionStore) forEachAccount(
+	fun func(account *bolt.Bucket) error,
+) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		accounts := tx.Bucket(ledgerAccountsBucket)
+
+		return accounts.ForEach(func(accountID, _ []byte) error {
+			account := accounts.Bucket(accountID)
+			if account == nil {
+				return nil
+			}
+
+			err := fun(account)
+			if err != nil {
+				return fmt.Errorf("account %s => %s", accountID, err)
+			}
+			return nil
+		})
+	})
+}
@@ -1,15 +1,54 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/tlwr/monzo-exporter/monzo"
 )
 
+// DefaultTransactionAmountBuckets are in minor units, from £1 to £500
+var DefaultTransactionAmountBuckets = []float64{
+	100, 500, 1000, 2500, 5000, 10000, 25000, 50000,
+}
+
+func newSpendTransactionAmountMetric(buckets []float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "monzo_spend_transaction_amount",
+			Help:    "Shows the distribution of amounts spent by individual settled transactions per category",
+			Buckets: buckets,
+		},
+		[]string{"user_id", "account_id", "category", "currency"},
+	)
+}
+
+// snapshotMetric is a gauge set from MonzoUserSnapshots
+//
+// It is either registered as a GaugeVec which is updated after every
+// collection, or served as constant metrics by the MonzoSnapshotCollector
+type snapshotMetric struct {
+	Name string
+	Vec  *prometheus.GaugeVec
+	Desc *prometheus.Desc
+}
+
+func newSnapshotMetric(opts prometheus.GaugeOpts, labels []string) *snapshotMetric {
+	return &snapshotMetric{
+		Name: opts.Name,
+		Vec:  prometheus.NewGaugeVec(opts, labels),
+		Desc: prometheus.NewDesc(opts.Name, opts.Help, labels, nil),
+	}
+}
+
 var (
-	currentBalanceMetric = prometheus.NewGaugeVec(
+	currentBalanceMetric = newSnapshotMetric(
 		prometheus.GaugeOpts{
 			Name: "monzo_current_balance",
 			Help: "Shows the currently spendable account balance",
@@ -17,7 +56,7 @@ var (
 		[]string{"user_id", "account_id"},
 	)
 
-	totalBalanceMetric = prometheus.NewGaugeVec(
+	totalBalanceMetric = newSnapshotMetric(
 		prometheus.GaugeOpts{
 			Name: "monzo_total_balance",
 			Help: "Shows the total account balance including pots",
@@ -25,7 +64,7 @@ var (
 		[]string{"user_id", "account_id"},
 	)
 
-	spendTodayMetric = prometheus.NewGaugeVec(
+	spendTodayMetric = newSnapshotMetric(
 		prometheus.GaugeOpts{
 			Name: "monzo_spend_today",
 			Help: "Shows the spend amount spent today",
@@ -33,7 +72,7 @@ var (
 		[]string{"user_id", "account_id"},
 	)
 
-	transactionsAmountToday = prometheus.NewGaugeVec(
+	transactionsAmountToday = newSnapshotMetric(
 		prometheus.GaugeOpts{
 			Name: "monzo_transactions_amount_today",
 			Help: "Shows the amount transacted today for a transaction description",
@@ -44,7 +83,50 @@ var (
 		},
 	)
 
-	potBalanceMetric = prometheus.NewGaugeVec(
+	spendWindowMetric = newSnapshotMetric(
+		prometheus.GaugeOpts{
+			Name: "monzo_spend_window",
+			Help: "Shows the amount spent per category over a window of days up to today",
+		},
+		[]string{
+			"user_id", "account_id",
+			"window", "category", "currency",
+		},
+	)
+
+	pendingAmountMetric = newSnapshotMetric(
+		prometheus.GaugeOpts{
+			Name: "monzo_pending_amount",
+			Help: "Shows the amount of transactions which have not yet settled",
+		},
+		[]string{"user_id", "account_id"},
+	)
+
+	pendingTransactionsMetric = newSnapshotMetric(
+		prometheus.GaugeOpts{
+			Name: "monzo_pending_transactions",
+			Help: "Shows the number of transactions which have not yet settled",
+		},
+		[]string{"user_id", "account_id"},
+	)
+
+	oldestPendingAgeMetric = newSnapshotMetric(
+		prometheus.GaugeOpts{
+			Name: "monzo_oldest_pending_transaction_age_seconds",
+			Help: "Shows how long ago the oldest transaction which has not yet settled was made, 0 when none are pending",
+		},
+		[]string{"user_id", "account_id"},
+	)
+
+	settledAmountTodayMetric = newSnapshotMetric(
+		prometheus.GaugeOpts{
+			Name: "monzo_settled_amount_today",
+			Help: "Shows the amount of transactions made today which have settled",
+		},
+		[]string{"user_id", "account_id"},
+	)
+
+	potBalanceMetric = newSnapshotMetric(
 		prometheus.GaugeOpts{
 			Name: "monzo_pot_balance",
 			Help: "Shows the individual pot balance",
@@ -52,7 +134,7 @@ var (
 		[]string{"user_id", "pot_id", "pot_name"},
 	)
 
-	userLatestCollectMetric = prometheus.NewGaugeVec(
+	userLatestCollectMetric = newSnapshotMetric(
 		prometheus.GaugeOpts{
 			Name: "monzo_user_latest_collect",
 			Help: "Shows the unix timestamp expiry for most recent data collection",
@@ -68,6 +150,46 @@ var (
 		[]string{"user_id"},
 	)
 
+	accessTokenNextRefreshMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "monzo_access_token_next_refresh",
+			Help: "Shows the unix timestamp of the next refresh attempt for the access token",
+		},
+		[]string{"user_id"},
+	)
+
+	accessTokenRefreshesMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_access_token_refreshes_total",
+			Help: "Shows the number of access token refreshes by result",
+		},
+		[]string{"user_id", "result"},
+	)
+
+	userAuthStateMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "monzo_user_auth_state",
+			Help: "Shows 1 for the current authentication state of the user and 0 for the others",
+		},
+		[]string{"user_id", "state"},
+	)
+
+	accessTokenReplacementsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_access_token_replacements_total",
+			Help: "Shows the number of times a user's tokens were replaced by a new OAuth journey",
+		},
+		[]string{"user_id"},
+	)
+
+	collectErrorsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_collect_errors_total",
+			Help: "Shows the number of errors collecting metrics per user and stage",
+		},
+		[]string{"user_id", "stage"},
+	)
+
 	monzoAPIResponseCodeMetric = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "monzo_api_response_code",
@@ -75,122 +197,246 @@ var (
 		},
 		[]string{"response_code", "endpoint"},
 	)
+
+	monzoAPIRequestDurationMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "monzo_api_request_duration_seconds",
+			Help: "Shows the duration of requests per endpoint and outcome to the Monzo API",
+		},
+		[]string{"endpoint", "outcome"},
+	)
+
+	monzoAPIRequestsInFlightMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "monzo_api_requests_in_flight",
+			Help: "Shows the number of requests per endpoint currently being made to the Monzo API",
+		},
+		[]string{"endpoint"},
+	)
+
+	monzoAPITransportErrorsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_api_transport_errors_total",
+			Help: "Shows the number of requests per endpoint to the Monzo API which failed without a response",
+		},
+		[]string{"endpoint", "reason"},
+	)
+
+	monzoAPIRetriesMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_api_retries_total",
+			Help: "Shows the number of retried requests per endpoint and reason to the Monzo API",
+		},
+		[]string{"endpoint", "reason"},
+	)
+
+	monzoAPIThrottleWaitMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_api_throttle_wait_seconds_total",
+			Help: "Shows the time spent waiting to retry requests throttled by the Monzo API",
+		},
+		[]string{"endpoint"},
+	)
+
+	monzoAPIBudgetExhaustedMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_api_budget_exhausted_total",
+			Help: "Shows the number of requests to the Monzo API not made because a request budget was exhausted",
+		},
+		[]string{"endpoint", "budget"},
+	)
+
+	backfillTransactionsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_backfill_transactions_total",
+			Help: "Shows the number of transactions backfilled per account",
+		},
+		[]string{"user_id", "account_id"},
+	)
+
+	backfillProgressMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "monzo_backfill_progress_timestamp",
+			Help: "Shows the unix timestamp of the newest transaction backfilled per account",
+		},
+		[]string{"user_id", "account_id"},
+	)
+
+	backfillCompleteMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "monzo_backfill_complete",
+			Help: "Shows 1 when the history of the account has been backfilled and 0 whilst it is being backfilled",
+		},
+		[]string{"user_id", "account_id"},
+	)
+
+	tokenStoreErrorsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "monzo_token_store_errors_total",
+			Help: "Shows the number of errors loading or saving the OAuth token store",
+		},
+		[]string{"operation", "reason"},
+	)
+
+	dailyResetInfoMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "monzo_daily_reset_info",
+			Help: "Shows the schedule and timezone on which the amounts transacted today are reset",
+		},
+		[]string{"schedule", "timezone"},
+	)
+
+	dailyResetLastMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "monzo_daily_reset_last_timestamp",
+			Help: "Shows the unix timestamp of the last reset of the amounts transacted today",
+		},
+	)
+
+	dailyResetNextMetric = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "monzo_daily_reset_next_timestamp",
+			Help: "Shows the unix timestamp of the next reset of the amounts transacted today",
+		},
+	)
+
+	spendTransactionAmountMetric = newSpendTransactionAmountMetric(
+		DefaultTransactionAmountBuckets,
+	)
 )
 
+var snapshotMetrics = []*snapshotMetric{
+	currentBalanceMetric,
+	totalBalanceMetric,
+	spendTodayMetric,
+	transactionsAmountToday,
+	spendWindowMetric,
+	pendingAmountMetric,
+	pendingTransactionsMetric,
+	oldestPendingAgeMetric,
+	settledAmountTodayMetric,
+	potBalanceMetric,
+	userLatestCollectMetric,
+}
+
+func RegisterSnapshotMetrics() {
+	for _, metric := range snapshotMetrics {
+		prometheus.MustRegister(metric.Vec)
+	}
+}
+
 func RegisterCustomMetrics() {
-	prometheus.MustRegister(currentBalanceMetric)
-	prometheus.MustRegister(totalBalanceMetric)
-	prometheus.MustRegister(spendTodayMetric)
-	prometheus.MustRegister(transactionsAmountToday)
-	prometheus.MustRegister(potBalanceMetric)
-	prometheus.MustRegister(userLatestCollectMetric)
 	prometheus.MustRegister(accessTokenExpiryMetric)
+	prometheus.MustRegister(accessTokenNextRefreshMetric)
+	prometheus.MustRegister(accessTokenRefreshesMetric)
+	prometheus.MustRegister(userAuthStateMetric)
+	prometheus.MustRegister(accessTokenReplacementsMetric)
+	prometheus.MustRegister(collectErrorsMetric)
 	prometheus.MustRegister(monzoAPIResponseCodeMetric)
+	prometheus.MustRegister(monzoAPIRequestDurationMetric)
+	prometheus.MustRegister(monzoAPIRequestsInFlightMetric)
+	prometheus.MustRegister(monzoAPITransportErrorsMetric)
+	prometheus.MustRegister(monzoAPIRetriesMetric)
+	prometheus.MustRegister(monzoAPIThrottleWaitMetric)
+	prometheus.MustRegister(monzoAPIBudgetExhaustedMetric)
+	prometheus.MustRegister(tokenStoreErrorsMetric)
+	prometheus.MustRegister(backfillTransactionsMetric)
+	prometheus.MustRegister(backfillProgressMetric)
+	prometheus.MustRegister(backfillCompleteMetric)
+	prometheus.MustRegister(dailyResetInfoMetric)
+	prometheus.MustRegister(dailyResetLastMetric)
+	prometheus.MustRegister(dailyResetNextMetric)
+	prometheus.MustRegister(spendTransactionAmountMetric)
 }
 
-func SetCurrentBalance(
+func SetAccessTokenExpiry(
 	userID MonzoUserID,
-	accountID MonzoAccountID,
-	balance int64,
+	expiryTime time.Time,
 ) {
 	log.Printf(
-		"Setting monzo_current_balance for user %s for account %s to %d",
-		userID, accountID, balance,
+		"Setting monzo_access_token_expiry for user %s to %d",
+		userID, expiryTime.Unix(),
 	)
 
-	currentBalanceMetric.With(
+	accessTokenExpiryMetric.With(
 		prometheus.Labels{
-			"user_id":    string(userID),
-			"account_id": string(accountID),
+			"user_id": string(userID),
 		},
-	).Set(float64(balance))
+	).Set(float64(expiryTime.Unix()))
 }
 
-func SetTotalBalance(
+func SetAccessTokenNextRefresh(
 	userID MonzoUserID,
-	accountID MonzoAccountID,
-	balance int64,
+	nextRefresh time.Time,
 ) {
 	log.Printf(
-		"Setting monzo_total_balance for user %s for account %s to %d",
-		userID, accountID, balance,
+		"Setting monzo_access_token_next_refresh for user %s to %d",
+		userID, nextRefresh.Unix(),
 	)
 
-	totalBalanceMetric.With(
+	accessTokenNextRefreshMetric.With(
 		prometheus.Labels{
-			"user_id":    string(userID),
-			"account_id": string(accountID),
+			"user_id": string(userID),
 		},
-	).Set(float64(balance))
+	).Set(float64(nextRefresh.Unix()))
 }
 
-func SetSpendToday(
-	userID MonzoUserID,
-	accountID MonzoAccountID,
-	spend int64,
-) {
+func IncAccessTokenRefreshes(userID MonzoUserID, result string) {
 	log.Printf(
-		"Setting monzo_spend_today for user %s for account %s to %d",
-		userID, accountID, spend,
+		"Incrementing monzo_access_token_refreshes_total for user %s result %s",
+		userID, result,
 	)
 
-	spendTodayMetric.With(
+	accessTokenRefreshesMetric.With(
 		prometheus.Labels{
-			"user_id":    string(userID),
-			"account_id": string(accountID),
+			"user_id": string(userID),
+			"result":  result,
 		},
-	).Set(float64(spend))
+	).Inc()
 }
 
-func SetPotBalance(
-	userID MonzoUserID,
-	potID MonzoPotID,
-	potName string,
-	balance int64,
-) {
-	log.Printf(
-		"Setting monzo_pot_balance for user %s for pot %s to %d",
-		userID, potID, balance,
-	)
+func SetUserAuthState(userID MonzoUserID, state MonzoUserAuthState) {
+	log.Printf("Setting monzo_user_auth_state for user %s to %s", userID, state)
 
-	potBalanceMetric.With(
-		prometheus.Labels{
-			"user_id":  string(userID),
-			"pot_id":   string(potID),
-			"pot_name": potName,
-		},
-	).Set(float64(balance))
-}
+	for _, possibleState := range MonzoUserAuthStates {
+		value := 0.0
+		if possibleState == state {
+			value = 1.0
+		}
 
-func SetUserLatestCollect(userID MonzoUserID) {
-	timestamp := time.Now().Unix()
+		userAuthStateMetric.With(
+			prometheus.Labels{
+				"user_id": string(userID),
+				"state":   string(possibleState),
+			},
+		).Set(value)
+	}
+}
 
+func IncAccessTokenReplacements(userID MonzoUserID) {
 	log.Printf(
-		"Setting monzo_user_latest_collect for user %s to %d",
-		userID, timestamp,
+		"Incrementing monzo_access_token_replacements_total for user %s", userID,
 	)
 
-	userLatestCollectMetric.With(
+	accessTokenReplacementsMetric.With(
 		prometheus.Labels{
 			"user_id": string(userID),
 		},
-	).Set(float64(timestamp))
+	).Inc()
 }
 
-func SetAccessTokenExpiry(
-	userID MonzoUserID,
-	expiryTime time.Time,
-) {
+func IncCollectErrors(userID MonzoUserID, stage string) {
 	log.Printf(
-		"Setting monzo_access_token_expiry for user %s to %d",
-		userID, expiryTime.Unix(),
+		"Incrementing monzo_collect_errors_total for user %s stage %s",
+		userID, stage,
 	)
 
-	accessTokenExpiryMetric.With(
+	collectErrorsMetric.With(
 		prometheus.Labels{
 			"user_id": string(userID),
+			"stage":   stage,
 		},
-	).Set(float64(expiryTime.Unix()))
+	).Inc()
 }
 
 func IncMonzoAPIResponseCode(
@@ -210,29 +456,203 @@ func IncMonzoAPIResponseCode(
 	).Inc()
 }
 
-func SetTransactionsAmountToday(
-	userID MonzoUserID, accountID MonzoAccountID,
-	transactionsSummary MonzoTransactionsSummary,
+func ObserveMonzoAPIRequestDuration(
+	endpoint string,
+	outcome string,
+	duration time.Duration,
 ) {
+	monzoAPIRequestDurationMetric.With(
+		prometheus.Labels{
+			"endpoint": endpoint,
+			"outcome":  outcome,
+		},
+	).Observe(duration.Seconds())
+}
+
+func IncMonzoAPIRequestsInFlight(endpoint string) {
+	monzoAPIRequestsInFlightMetric.With(
+		prometheus.Labels{
+			"endpoint": endpoint,
+		},
+	).Inc()
+}
+
+func DecMonzoAPIRequestsInFlight(endpoint string) {
+	monzoAPIRequestsInFlightMetric.With(
+		prometheus.Labels{
+			"endpoint": endpoint,
+		},
+	).Dec()
+}
+
+func IncMonzoAPITransportErrors(endpoint string, reason string) {
+	log.Printf(
+		"Incrementing monzo_api_transport_errors_total for endpoint %s reason %s",
+		endpoint, reason,
+	)
+
+	monzoAPITransportErrorsMetric.With(
+		prometheus.Labels{
+			"endpoint": endpoint,
+			"reason":   reason,
+		},
+	).Inc()
+}
+
+func IncMonzoAPIRetries(endpoint string, reason string, wait time.Duration) {
+	log.Printf(
+		"Incrementing monzo_api_retries_total for endpoint %s reason %s, waiting %s",
+		endpoint, reason, wait,
+	)
+
+	monzoAPIRetriesMetric.With(
+		prometheus.Labels{
+			"endpoint": endpoint,
+			"reason":   reason,
+		},
+	).Inc()
+
+	if reason == monzo.RETRY_REASON_RATE_LIMITED {
+		monzoAPIThrottleWaitMetric.With(
+			prometheus.Labels{
+				"endpoint": endpoint,
+			},
+		).Add(wait.Seconds())
+	}
+}
+
+func IncMonzoAPIBudgetExhausted(endpoint string, budget string) {
+	log.Printf(
+		"Incrementing monzo_api_budget_exhausted_total for endpoint %s budget %s",
+		endpoint, budget,
+	)
+
+	monzoAPIBudgetExhaustedMetric.With(
+		prometheus.Labels{
+			"endpoint": endpoint,
+			"budget":   budget,
+		},
+	).Inc()
+}
+
+func SetDailyResetInfo(schedule string, location *time.Location) {
+	dailyResetInfoMetric.With(
+		prometheus.Labels{
+			"schedule": schedule,
+			"timezone": location.String(),
+		},
+	).Set(1)
+}
+
+func SetDailyResetLast(last time.Time) {
+	log.Printf("Setting monzo_daily_reset_last_timestamp to %d", last.Unix())
+	dailyResetLastMetric.Set(float64(last.Unix()))
+}
+
+func SetDailyResetNext(next time.Time) {
+	log.Printf("Setting monzo_daily_reset_next_timestamp to %d", next.Unix())
+	dailyResetNextMetric.Set(float64(next.Unix()))
+}
+
+func IncTokenStoreErrors(operation string, err error) {
+	reason := "unknown"
+
+	var storeErr *MonzoTokenStoreError
+	if errors.As(err, &storeErr) {
+		reason = storeErr.Reason
+	}
+
 	log.Printf(
-		"Setting monzo_transactions_amount_today for User %s for Account %s for Description %s for Category %s to %d",
-		userID, accountID,
-		transactionsSummary.Description, transactionsSummary.Category,
-		transactionsSummary.Amount,
+		"Incrementing monzo_token_store_errors_total for operation %s reason %s",
+		operation, reason,
 	)
 
-	transactionsAmountToday.With(
+	tokenStoreErrorsMetric.With(
+		prometheus.Labels{
+			"operation": operation,
+			"reason":    reason,
+		},
+	).Inc()
+}
+
+func AddBackfillTransactions(
+	userID MonzoUserID, accountID MonzoAccountID, count int,
+) {
+	backfillTransactionsMetric.With(
+		prometheus.Labels{
+			"user_id":    string(userID),
+			"account_id": string(accountID),
+		},
+	).Add(float64(count))
+}
+
+func SetBackfillProgress(
+	userID MonzoUserID, accountID MonzoAccountID, progress time.Time,
+) {
+	backfillProgressMetric.With(
+		prometheus.Labels{
+			"user_id":    string(userID),
+			"account_id": string(accountID),
+		},
+	).Set(float64(progress.Unix()))
+}
+
+func SetBackfillComplete(
+	userID MonzoUserID, accountID MonzoAccountID, complete bool,
+) {
+	value := 0.0
+	if complete {
+		value = 1.0
+	}
+
+	backfillCompleteMetric.With(
 		prometheus.Labels{
-			"user_id":     string(userID),
-			"account_id":  string(accountID),
-			"description": transactionsSummary.Description,
-			"category":    transactionsSummary.Category,
+			"user_id":    string(userID),
+			"account_id": string(accountID),
 		},
-	).Set(float64(transactionsSummary.Amount))
+	).Set(value)
+}
+
+// SetTransactionAmountBuckets must be called before RegisterCustomMetrics
+func SetTransactionAmountBuckets(buckets []float64) {
+	spendTransactionAmountMetric = newSpendTransactionAmountMetric(buckets)
 }
 
-func ResetTransactionsAmountToday() {
-	log.Println("Resetting monzo_transactions_amount_today")
-	transactionsAmountToday.Reset()
-	log.Println("Reset monzo_transactions_amount_today")
+// ParseTransactionAmountBuckets parses comma separated bucket upper bounds,
+// which must be in increasing order
+func ParseTransactionAmountBuckets(commaSeparated string) ([]float64, error) {
+	buckets := make([]float64, 0)
+
+	for _, field := range strings.Split(commaSeparated, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse bucket %q => %s", field, err)
+		}
+
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket %v is not greater than the one before", bucket)
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, nil
+}
+
+// ObserveCountedTransaction records the amount of a spending transaction once
+// it has been counted in the totals of its account, see countLedgerEntry
+func ObserveCountedTransaction(
+	userID MonzoUserID, accountID MonzoAccountID, transaction MonzoTransaction,
+) {
+	if !transaction.IsSpending() {
+		return
+	}
+
+	spendTransactionAmountMetric.With(
+		prometheus.Labels{
+			"user_id":    string(userID),
+			"account_id": string(accountID),
+			"category":   transaction.Category,
+			"currency":   string(transaction.Currency),
+		},
+	).Observe(float64(-transaction.Amount))
 }
@@ -1,28 +1,53 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"strings"
 	"sync"
-	"time"
-
-	"github.com/h2non/gentleman"
-	"github.com/h2non/gentleman/plugins/multipart"
 )
 
 const (
-	STATE_COOKIE_NAME = "monzo_exporter_state"
-	STATE_LENGTH      = 32
+	STATE_COOKIE_NAME  = "monzo_exporter_state"
+	STATUS_COOKIE_NAME = "monzo_exporter_status"
+	STATE_LENGTH       = 32
 
 	START_PATH    = "/token/start"
 	CALLBACK_PATH = "/token/callback"
+	STATUS_PATH   = "/token/status"
 )
 
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Monzo exporter</title></head>
+<body>
+<h1>Monzo exporter</h1>
+{{- if .Users }}
+<table>
+<tr><th>User</th><th>State</th><th></th></tr>
+{{- range .Users }}
+<tr>
+<td>{{ .UserID }}</td>
+<td>{{ .AuthState }}</td>
+<td>
+{{- if eq .AuthState "needs_reauthentication" }}<a href="{{ $.StartPath }}">Sign in to Monzo again</a>{{ end }}
+{{- if eq .AuthState "pending_approval" }}Open the Monzo app to approve access{{ end -}}
+</td>
+</tr>
+{{- end }}
+</table>
+{{- end }}
+<p><a href="{{ $.StartPath }}">Sign in to Monzo</a></p>
+</body>
+</html>
+`))
+
 func generateRandomState() string {
 	randomBytes := make([]byte, STATE_LENGTH)
 	_, err := rand.Read(randomBytes)
@@ -34,6 +59,45 @@ func generateRandomState() string {
 	return hex.EncodeToString(randomBytes)
 }
 
+// statusSessions remember which user completed the OAuth journey in which
+// browser, so that the status page only ever shows users their own state
+type statusSessions struct {
+	lock  sync.Mutex
+	users map[string]MonzoUserID
+}
+
+func (s *statusSessions) add(userID MonzoUserID) string {
+	session := generateRandomState()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.users == nil {
+		s.users = make(map[string]MonzoUserID)
+	}
+	s.users[session] = userID
+	return session
+}
+
+func (s *statusSessions) user(session string) (MonzoUserID, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	userID, ok := s.users[session]
+	return userID, ok
+}
+
+func (m *MonzoOAuthClient) authURL() string {
+	if m.AuthURL == "" {
+		return DefaultMonzoAuthEndpoint
+	}
+	return m.AuthURL
+}
+
+func (m *MonzoOAuthClient) oauthAPI() MonzoOAuthAPI {
+	return NewMonzoOAuthAPI(m.MonzoOAuthClientID, m.MonzoOAuthClientSecret)
+}
+
 func (m *MonzoOAuthClient) redirectURL() string {
 	return m.ExternalURL + CALLBACK_PATH
 }
@@ -50,7 +114,7 @@ func (m *MonzoOAuthClient) handleJourneyStart(w http.ResponseWriter, r *http.Req
 		"state=" + state,
 		"response_type=" + "code",
 	}, "&")
-	monzoAuthURI := fmt.Sprintf("https://auth.monzo.com?%s", query)
+	monzoAuthURI := fmt.Sprintf("%s?%s", m.authURL(), query)
 
 	log.Printf("handleJourneyStart: Redirecting user to %s\n", monzoAuthURI)
 	http.Redirect(w, r, monzoAuthURI, 302)
@@ -92,24 +156,16 @@ func (m *MonzoOAuthClient) handleJourneyCallback(w http.ResponseWriter, r *http.
 
 	requestCode := requestCodes[0]
 
-	fields := multipart.DataFields{
-		"grant_type":    {"authorization_code"},
-		"client_id":     {m.MonzoOAuthClientID},
-		"client_secret": {m.MonzoOAuthClientSecret},
-		"redirect_uri":  {m.redirectURL()},
-		"code":          {requestCode},
-	}
-
-	authURL := fmt.Sprintf("%s/oauth2/token", MonzoAPIEndpoint)
-
-	client := gentleman.New()
-	client.URL(authURL)
-	client.Use(multipart.Fields(fields))
-
-	log.Printf("handleJourneyCallback: Making POST request to %s\n", authURL)
-	response, err := client.Request().Method("POST").Send()
+	log.Println("handleJourneyCallback: Exchanging authorization code")
+	authResponse, err := m.oauthAPI().ExchangeAuthorizationCode(
+		r.Context(), m.redirectURL(), requestCode,
+	)
 
 	if err != nil {
+		log.Printf(
+			"handleJourneyCallback: Encountered error exchanging authorization code => %s",
+			err,
+		)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(
 			fmt.Sprintf("500 - Error making request to Monzo"),
@@ -117,47 +173,45 @@ func (m *MonzoOAuthClient) handleJourneyCallback(w http.ResponseWriter, r *http.
 		return
 	}
 
-	log.Printf(
-		"handleJourneyCallback: Response to POST request to %s was %d\n",
-		authURL, response.StatusCode,
-	)
-
-	var authResponse MonzoAuthResponse
-	err = json.Unmarshal(response.Bytes(), &authResponse)
+	newTokens := tokensFromAuthResponse(authResponse)
+	expiryTime := newTokens.ExpiryTime
 
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - could not unmarshal JSON from Monzo"))
-		return
-	}
-
-	expiryTime := time.Now().Add(
-		time.Duration(authResponse.ExpirySeconds-300) * time.Second,
-	)
-
-	log.Println("handleJourneyCallback: Locking TokensBox")
-	m.TokensBox.Lock.Lock()
+	oldTokens, replaced := m.putTokens(newTokens)
 
-	defer func() {
-		log.Println("handleJourneyCallback: Unlocking TokensBox")
-		m.TokensBox.Lock.Unlock()
-	}()
+	if replaced && oldTokens.AccessToken != newTokens.AccessToken {
+		log.Printf(
+			"handleJourneyCallback: Replaced tokens for user %s, invalidating old tokens",
+			authResponse.UserID,
+		)
+		IncAccessTokenReplacements(authResponse.UserID)
 
-	m.TokensBox.Tokens = append(
-		m.TokensBox.Tokens,
-		MonzoAccessAndRefreshTokens{
-			AccessToken:  authResponse.AccessToken,
-			RefreshToken: authResponse.RefreshToken,
-			UserID:       authResponse.UserID,
-			ExpiryTime:   expiryTime,
-		},
-	)
-	log.Println("handleJourneyCallback: Appended to TokensBox")
+		err = NewMonzoAPI(string(oldTokens.AccessToken)).Logout(r.Context())
+		if err != nil {
+			log.Printf(
+				"handleJourneyCallback: Could not invalidate old tokens for user %s => %s",
+				authResponse.UserID, err,
+			)
+		}
+	}
 
 	SetAccessTokenExpiry(authResponse.UserID, expiryTime)
+	// Monzo does not allow access to data until the user approves it in their
+	// app, the collector notices once they have
+	ObserveUserAuthState(authResponse.UserID, USER_AUTH_STATE_PENDING_APPROVAL)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     STATUS_COOKIE_NAME,
+		Value:    m.sessions.add(authResponse.UserID),
+		Path:     STATUS_PATH,
+		HttpOnly: true,
+	})
 
 	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte("201 - Tokens received and accepted"))
+	w.Write([]byte(
+		"201 - Tokens received and accepted. " +
+			"Open the Monzo app and approve access to finish signing in, " +
+			"progress is shown at " + STATUS_PATH,
+	))
 }
 
 func (m *MonzoOAuthClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -179,25 +233,74 @@ func (m *MonzoOAuthClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		m.handleJourneyCallback(w, r)
 		return
 	}
+	if path == STATUS_PATH {
+		m.handleStatus(w, r)
+		return
+	}
 
 	w.WriteHeader(http.StatusNotFound)
 	w.Write([]byte("404 - Not found"))
 	log.Printf("ServeHTTP: Served 404 for %s\n", path)
 }
 
+type userStatus struct {
+	UserID    MonzoUserID
+	AuthState MonzoUserAuthState
+}
+
+// handleStatus shows the state of the user who completed the OAuth journey in
+// this browser, and nobody else, as the OAuth server is public
+func (m *MonzoOAuthClient) handleStatus(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]userStatus, 0)
+
+	var sessionUserID MonzoUserID
+	if statusCookie, err := r.Cookie(STATUS_COOKIE_NAME); err == nil {
+		sessionUserID, _ = m.sessions.user(statusCookie.Value)
+	}
+
+	for _, token := range m.CurrentTokens() {
+		if sessionUserID == "" || token.UserID != sessionUserID {
+			continue
+		}
+
+		state := token.AuthState
+
+		if observed, ok := ObservedUserAuthState(token.UserID); ok && state == USER_AUTH_STATE_ACTIVE {
+			state = observed
+		}
+
+		statuses = append(statuses, userStatus{token.UserID, state})
+	}
+
+	err := statusTemplate.Execute(w, struct {
+		StartPath string
+		Users     []userStatus
+	}{
+		StartPath: START_PATH,
+		Users:     statuses,
+	})
+
+	if err != nil {
+		log.Printf("handleStatus: Encountered error rendering status => %s", err)
+	}
+}
+
+// UsingAccessTokens calls fun with the access tokens of every active user
+//
+// The TokensBox is only locked whilst copying the tokens, so that collecting
+// does not hold up OAuth journeys, the status page or refreshing tokens
 func (m *MonzoOAuthClient) UsingAccessTokens(fun func([]string) error) error {
 	accessTokens := make([]string, 0)
 
-	log.Println("UsingAccessTokens: Locking TokensBox")
-	m.TokensBox.Lock.Lock()
-	log.Println("UsingAccessTokens: Locked TokensBox")
-
-	defer func() {
-		log.Println("UsingAccessTokens: Unlocking TokensBox")
-		m.TokensBox.Lock.Unlock()
-	}()
+	for _, accessAndRefreshTokens := range m.CurrentTokens() {
+		if accessAndRefreshTokens.AuthState != USER_AUTH_STATE_ACTIVE {
+			log.Printf(
+				"UsingAccessTokens: Skipping user %s in state %s",
+				accessAndRefreshTokens.UserID, accessAndRefreshTokens.AuthState,
+			)
+			continue
+		}
 
-	for _, accessAndRefreshTokens := range m.TokensBox.Tokens {
 		accessTokens = append(
 			accessTokens, string(accessAndRefreshTokens.AccessToken),
 		)
@@ -219,10 +322,118 @@ func (m *MonzoOAuthClient) UsingAccessTokens(fun func([]string) error) error {
 	return nil
 }
 
-func (m *MonzoOAuthClient) Start(port int) func(func([]string) error) error {
+// putTokens stores tokens for a user, returning the tokens they replace
+func (m *MonzoOAuthClient) putTokens(
+	tokens MonzoAccessAndRefreshTokens,
+) (MonzoAccessAndRefreshTokens, bool) {
+	log.Println("putTokens: Locking TokensBox")
+	m.TokensBox.Lock.Lock()
+
+	defer func() {
+		log.Println("putTokens: Unlocking TokensBox")
+		m.TokensBox.Lock.Unlock()
+	}()
+
+	oldTokens, replaced := m.TokensBox.Tokens[tokens.UserID]
+	m.TokensBox.Tokens[tokens.UserID] = tokens
+	log.Printf("putTokens: Put tokens for user %s in TokensBox", tokens.UserID)
+
+	err := m.persistTokens()
+	if err != nil {
+		log.Printf("putTokens: Could not persist tokens => %s", err)
+	}
+
+	return oldTokens, replaced
+}
+
+// setAuthState changes the state of a user's tokens, unless the user has been
+// given new tokens by an OAuth journey in the meantime
+func (m *MonzoOAuthClient) setAuthState(
+	tokens MonzoAccessAndRefreshTokens,
+	state MonzoUserAuthState,
+) {
+	log.Println("setAuthState: Locking TokensBox")
+	m.TokensBox.Lock.Lock()
+
+	defer func() {
+		log.Println("setAuthState: Unlocking TokensBox")
+		m.TokensBox.Lock.Unlock()
+	}()
+
+	current, ok := m.TokensBox.Tokens[tokens.UserID]
+	if !ok || current.RefreshToken != tokens.RefreshToken {
+		log.Printf(
+			"setAuthState: Tokens for user %s have changed, not setting %s",
+			tokens.UserID, state,
+		)
+		return
+	}
+
+	current.AuthState = state
+	m.TokensBox.Tokens[tokens.UserID] = current
+	log.Printf("setAuthState: User %s is now %s", tokens.UserID, state)
+
+	ObserveUserAuthState(tokens.UserID, state)
+
+	err := m.persistTokens()
+	if err != nil {
+		log.Printf("setAuthState: Could not persist tokens => %s", err)
+	}
+}
+
+// persistTokens must be called whilst holding the TokensBox lock
+func (m *MonzoOAuthClient) persistTokens() error {
+	tokens := m.TokensBox.tokensList()
+	log.Printf("persistTokens: Saving %d tokens", len(tokens))
+	err := m.TokensBox.Store.Save(tokens)
+	if err != nil {
+		IncTokenStoreErrors("save", err)
+	}
+	return err
+}
+
+// Start loads tokens from the TokenStore and serves the OAuth journey
+//
+// If the token store cannot be loaded, for example because it was encrypted
+// with a different key, the error is counted and returned without serving
+// anything, so that the store is never overwritten and no users are lost
+func (m *MonzoOAuthClient) Start(
+	port int,
+) (func(func([]string) error) error, error) {
+	store := m.TokenStore
+	if store == nil {
+		store = &InMemoryMonzoTokenStore{}
+	}
+
+	tokens, err := store.Load()
+	if err != nil {
+		log.Printf("Start: Could not load token store => %s", err)
+		IncTokenStoreErrors("load", err)
+		return nil, err
+	}
+
+	log.Printf("Start: Loaded %d tokens from token store", len(tokens))
+
 	m.TokensBox = ConcurrentMonzoTokensBox{
 		Lock:   sync.Mutex{},
-		Tokens: make([]MonzoAccessAndRefreshTokens, 0),
+		Tokens: make(map[MonzoUserID]MonzoAccessAndRefreshTokens),
+		Store:  store,
+	}
+
+	for _, token := range tokens {
+		existing, ok := m.TokensBox.Tokens[token.UserID]
+		if ok && existing.ExpiryTime.After(token.ExpiryTime) {
+			log.Printf("Start: Ignoring older duplicate tokens for user %s", token.UserID)
+			continue
+		}
+
+		if token.AuthState == "" {
+			token.AuthState = USER_AUTH_STATE_ACTIVE
+		}
+
+		m.TokensBox.Tokens[token.UserID] = token
+		SetAccessTokenExpiry(token.UserID, token.ExpiryTime)
+		ObserveUserAuthState(token.UserID, token.AuthState)
 	}
 
 	server := &http.Server{
@@ -231,52 +442,78 @@ func (m *MonzoOAuthClient) Start(port int) func(func([]string) error) error {
 	}
 
 	go server.ListenAndServe()
-	return m.UsingAccessTokens
+	return m.UsingAccessTokens, nil
 }
 
-func (m *MonzoOAuthClient) RefreshAToken() error {
-	log.Println("RefreshAToken: Locking TokensBox")
+// CurrentTokens returns a copy of the tokens for every user
+func (m *MonzoOAuthClient) CurrentTokens() []MonzoAccessAndRefreshTokens {
+	log.Println("CurrentTokens: Locking TokensBox")
 	m.TokensBox.Lock.Lock()
-	log.Println("RefreshAToken: Locked TokensBox")
-
-	tokens := m.TokensBox.Tokens
 
 	defer func() {
-		log.Println("RefreshAToken: Unlocking TokensBox")
+		log.Println("CurrentTokens: Unlocking TokensBox")
 		m.TokensBox.Lock.Unlock()
 	}()
 
-	if len(tokens) == 0 {
-		log.Println("RefreshAToken: No tokens to refresh. Done")
-		return nil
+	return m.TokensBox.tokensList()
+}
+
+// RefreshUserTokens refreshes a user's tokens and stores the result, unless
+// the user has been given new tokens by an OAuth journey in the meantime
+//
+// The TokensBox is not locked whilst talking to Monzo
+func (m *MonzoOAuthClient) RefreshUserTokens(
+	tokens MonzoAccessAndRefreshTokens,
+) (MonzoAccessAndRefreshTokens, error) {
+	log.Printf("RefreshUserTokens: Refreshing token for user %s", tokens.UserID)
+
+	authResponse, err := m.oauthAPI().RefreshToken(
+		context.Background(), tokens.RefreshToken,
+	)
+	refreshedTokens := tokensFromAuthResponse(authResponse)
+
+	var apiErr *MonzoAPIError
+	if errors.As(err, &apiErr) && apiErr.IsRefreshTokenRejected() {
+		log.Printf(
+			"RefreshUserTokens: Monzo rejected the refresh token for user %s",
+			tokens.UserID,
+		)
+		m.setAuthState(tokens, USER_AUTH_STATE_NEEDS_REAUTHENTICATION)
+	}
+
+	if err != nil {
+		return tokens, fmt.Errorf(
+			"RefreshUserTokens: Encountered error refreshing token for user %s => %w",
+			tokens.UserID, err,
+		)
 	}
 
-	headToken := m.TokensBox.Tokens[0]
-	tailTokens := m.TokensBox.Tokens[1:]
+	log.Println("RefreshUserTokens: Locking TokensBox")
+	m.TokensBox.Lock.Lock()
 
-	doWeNeedToRefresh := true // FIXME
-	if doWeNeedToRefresh {
-		log.Printf("RefreshAToken: Refreshing token for user %s", headToken.UserID)
+	defer func() {
+		log.Println("RefreshUserTokens: Unlocking TokensBox")
+		m.TokensBox.Lock.Unlock()
+	}()
 
-		refreshedToken, err := RefreshToken(
-			m.MonzoOAuthClientID, m.MonzoOAuthClientSecret,
-			string(headToken.AccessToken), string(headToken.RefreshToken),
+	current, ok := m.TokensBox.Tokens[tokens.UserID]
+	if !ok || current.RefreshToken != tokens.RefreshToken {
+		log.Printf(
+			"RefreshUserTokens: Tokens for user %s changed whilst refreshing, discarding",
+			tokens.UserID,
 		)
+		return current, nil
+	}
 
-		if err != nil {
-			return fmt.Errorf(
-				"RefreshAToken: Encountered error refreshing token for user %s => %s",
-				headToken.UserID, err,
-			)
-		}
+	m.TokensBox.Tokens[tokens.UserID] = refreshedTokens
+	log.Printf("RefreshUserTokens: Refreshed token for user %s", tokens.UserID)
 
-		headToken = refreshedToken
-		log.Printf("RefreshAToken: Refreshed token for user %s", headToken.UserID)
+	SetAccessTokenExpiry(refreshedTokens.UserID, refreshedTokens.ExpiryTime)
 
-		SetAccessTokenExpiry(headToken.UserID, headToken.ExpiryTime)
+	err = m.persistTokens()
+	if err != nil {
+		log.Printf("RefreshUserTokens: Could not persist tokens => %s", err)
 	}
 
-	m.TokensBox.Tokens = append(tailTokens, headToken)
-	log.Println("RefreshAToken: Rotated tokens")
-	return nil
+	return refreshedTokens, nil
 }
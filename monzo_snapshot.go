@@ -0,0 +1,273 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MonzoAccountSnapshot is everything collected for an account in one cycle
+//
+// A field is nil when collecting it failed, so that the previous value is
+// kept rather than being replaced by an empty one
+type MonzoAccountSnapshot struct {
+	AccountID MonzoAccountID
+
+	Balance              *MonzoBalance
+	TransactionSummaries []MonzoTransactionsSummary
+	SpendWindows         []MonzoSpendWindowSummary
+	Settlement           *MonzoSettlementSummary
+	Pots                 []MonzoPot
+}
+
+// MonzoUserSnapshot is everything collected for a user in one cycle
+type MonzoUserSnapshot struct {
+	UserID      MonzoUserID
+	CollectedAt time.Time
+
+	Accounts []*MonzoAccountSnapshot
+}
+
+// snapshotSample is a single value of a snapshotMetric, with label values in
+// the order the metric's labels were declared
+type snapshotSample struct {
+	Metric      *snapshotMetric
+	LabelValues []string
+	Value       float64
+}
+
+func (s *MonzoUserSnapshot) Samples() []snapshotSample {
+	userID := string(s.UserID)
+	samples := make([]snapshotSample, 0)
+
+	add := func(metric *snapshotMetric, value float64, labelValues ...string) {
+		samples = append(samples, snapshotSample{metric, labelValues, value})
+	}
+
+	for _, account := range s.Accounts {
+		accountID := string(account.AccountID)
+
+		if account.Balance != nil {
+			add(currentBalanceMetric, float64(account.Balance.Balance), userID, accountID)
+			add(totalBalanceMetric, float64(account.Balance.TotalBalance), userID, accountID)
+			add(spendTodayMetric, float64(account.Balance.SpendToday), userID, accountID)
+		}
+
+		for _, summary := range account.TransactionSummaries {
+			add(
+				transactionsAmountToday, float64(summary.Amount),
+				userID, accountID, summary.Description, summary.Category,
+			)
+		}
+
+		for _, summary := range account.SpendWindows {
+			add(
+				spendWindowMetric, float64(summary.Amount),
+				userID, accountID, summary.Window, summary.Category,
+				string(summary.Currency),
+			)
+		}
+
+		if account.Settlement != nil {
+			// Clamped to 0 in case of clock differences with Monzo
+			oldestPendingAge := 0.0
+			if oldest := account.Settlement.OldestPending; !oldest.IsZero() {
+				oldestPendingAge = math.Max(0, s.CollectedAt.Sub(oldest).Seconds())
+			}
+
+			add(pendingAmountMetric, float64(account.Settlement.PendingAmount), userID, accountID)
+			add(pendingTransactionsMetric, float64(account.Settlement.PendingTransactions), userID, accountID)
+			add(oldestPendingAgeMetric, oldestPendingAge, userID, accountID)
+			add(settledAmountTodayMetric, float64(account.Settlement.SettledAmountToday), userID, accountID)
+		}
+
+		for _, pot := range account.Pots {
+			add(potBalanceMetric, float64(pot.Balance), userID, string(pot.ID), pot.Name)
+		}
+	}
+
+	add(userLatestCollectMetric, float64(s.CollectedAt.Unix()), userID)
+	return samples
+}
+
+// MonzoCollectCycle is everything collected in one collection cycle
+type MonzoCollectCycle struct {
+	CollectedAt time.Time
+	Snapshots   []*MonzoUserSnapshot
+
+	// Unidentified is the number of tokens whose user could not be identified
+	Unidentified int
+
+	// FailedUsers could be identified but their accounts could not be listed
+	FailedUsers []MonzoUserID
+}
+
+// SnapshotPublisher receives what was collected in each cycle
+type SnapshotPublisher interface {
+	Publish(cycle MonzoCollectCycle)
+
+	// ResetDay clears the amounts transacted today until the next cycle
+	ResetDay()
+}
+
+// carryForward works out the latest snapshot of every user from a cycle
+//
+// Whatever failed to be collected in the cycle is carried forward from the
+// previous snapshots, whereas accounts and pots which were not listed, and
+// users whose tokens were not used, are dropped. When a token could not be
+// identified, no users are dropped, as it could have belonged to any of them
+func carryForward(
+	previous map[MonzoUserID]*MonzoUserSnapshot,
+	cycle MonzoCollectCycle,
+) map[MonzoUserID]*MonzoUserSnapshot {
+	latest := make(map[MonzoUserID]*MonzoUserSnapshot)
+
+	for _, snapshot := range cycle.Snapshots {
+		previousSnapshot, ok := previous[snapshot.UserID]
+		if ok {
+			snapshot.fillFrom(previousSnapshot)
+		}
+		latest[snapshot.UserID] = snapshot
+	}
+
+	for _, userID := range cycle.FailedUsers {
+		if snapshot, ok := previous[userID]; ok {
+			log.Printf("carryForward: Keeping previous snapshot for user %s", userID)
+			latest[userID] = snapshot
+		}
+	}
+
+	if cycle.Unidentified > 0 {
+		for userID, snapshot := range previous {
+			if _, ok := latest[userID]; !ok {
+				log.Printf(
+					"carryForward: Keeping previous snapshot for user %s as %d tokens were unidentified",
+					userID, cycle.Unidentified,
+				)
+				latest[userID] = snapshot
+			}
+		}
+	}
+
+	return latest
+}
+
+// fillFrom copies whatever failed to be collected from a previous snapshot
+func (s *MonzoUserSnapshot) fillFrom(previous *MonzoUserSnapshot) {
+	previousAccounts := make(map[MonzoAccountID]*MonzoAccountSnapshot)
+	for _, account := range previous.Accounts {
+		previousAccounts[account.AccountID] = account
+	}
+
+	for _, account := range s.Accounts {
+		previousAccount, ok := previousAccounts[account.AccountID]
+		if !ok {
+			continue
+		}
+
+		if account.Balance == nil {
+			account.Balance = previousAccount.Balance
+		}
+		if account.TransactionSummaries == nil {
+			account.TransactionSummaries = previousAccount.TransactionSummaries
+		}
+		if account.Settlement == nil {
+			account.Settlement = previousAccount.Settlement
+		}
+		if account.SpendWindows == nil {
+			account.SpendWindows = previousAccount.SpendWindows
+		}
+		if account.Pots == nil {
+			account.Pots = previousAccount.Pots
+		}
+	}
+}
+
+// resetDay clears the transaction summaries of every account, leaving them
+// empty rather than nil so that the previous day is not carried forward
+func resetDay(snapshots map[MonzoUserID]*MonzoUserSnapshot) {
+	for _, snapshot := range snapshots {
+		for _, account := range snapshot.Accounts {
+			account.TransactionSummaries = make([]MonzoTransactionsSummary, 0)
+
+			// The summary can be shared with an earlier snapshot, so is copied
+			if account.Settlement != nil {
+				settlement := *account.Settlement
+				settlement.SettledAmountToday = 0
+				account.Settlement = &settlement
+			}
+		}
+	}
+}
+
+func (s snapshotSample) key() string {
+	return s.Metric.Name + "\xff" + strings.Join(s.LabelValues, "\xff")
+}
+
+// GaugeSnapshotPublisher sets the registered snapshotMetric GaugeVecs, and
+// deletes any series which are no longer part of the latest snapshots
+type GaugeSnapshotPublisher struct {
+	lock sync.Mutex
+
+	snapshots map[MonzoUserID]*MonzoUserSnapshot
+	published map[string]snapshotSample
+}
+
+func NewGaugeSnapshotPublisher() *GaugeSnapshotPublisher {
+	return &GaugeSnapshotPublisher{
+		snapshots: make(map[MonzoUserID]*MonzoUserSnapshot),
+		published: make(map[string]snapshotSample),
+	}
+}
+
+func (p *GaugeSnapshotPublisher) Publish(cycle MonzoCollectCycle) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.snapshots = carryForward(p.snapshots, cycle)
+	p.publish()
+}
+
+func (p *GaugeSnapshotPublisher) ResetDay() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	resetDay(p.snapshots)
+	p.publish()
+}
+
+// publish must be called whilst holding the lock
+func (p *GaugeSnapshotPublisher) publish() {
+	live := make(map[string]snapshotSample)
+
+	for _, snapshot := range p.snapshots {
+		log.Printf("Publish: Publishing user %s", snapshot.UserID)
+
+		for _, sample := range snapshot.Samples() {
+			log.Printf(
+				"Setting %s for %v to %f",
+				sample.Metric.Name, sample.LabelValues, sample.Value,
+			)
+
+			sample.Metric.Vec.WithLabelValues(sample.LabelValues...).Set(sample.Value)
+			live[sample.key()] = sample
+		}
+
+		log.Printf("Publish: Published user %s", snapshot.UserID)
+	}
+
+	for key, sample := range p.published {
+		if _, ok := live[key]; ok {
+			continue
+		}
+
+		log.Printf(
+			"Deleting stale %s for %v", sample.Metric.Name, sample.LabelValues,
+		)
+		sample.Metric.Vec.DeleteLabelValues(sample.LabelValues...)
+	}
+
+	p.published = live
+}
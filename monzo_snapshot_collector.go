@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MonzoSnapshotCollector serves the snapshots from the latest collection
+// cycle on each scrape
+//
+// Every cycle replaces the snapshots, so series for pots, accounts or users
+// which are no longer listed are not served, see carryForward
+//
+// When refresh is set and the snapshots are older than minAge, a scrape
+// waits for a new collection cycle first. refresh is given a func which
+// checks the age again once it is its turn to collect, so that a scrape which
+// waited for a cycle already running does not start another
+type MonzoSnapshotCollector struct {
+	minAge  time.Duration
+	refresh func(needed func() bool) error
+
+	refreshLock sync.Mutex
+
+	lock        sync.RWMutex
+	collectedAt time.Time
+	snapshots   map[MonzoUserID]*MonzoUserSnapshot
+}
+
+func NewMonzoSnapshotCollector(
+	minAge time.Duration,
+	refresh func(needed func() bool) error,
+) *MonzoSnapshotCollector {
+	return &MonzoSnapshotCollector{
+		minAge:    minAge,
+		refresh:   refresh,
+		snapshots: make(map[MonzoUserID]*MonzoUserSnapshot),
+	}
+}
+
+func (c *MonzoSnapshotCollector) Publish(cycle MonzoCollectCycle) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.collectedAt = cycle.CollectedAt
+	c.snapshots = carryForward(c.snapshots, cycle)
+	log.Printf("Publish: Replaced snapshots with %d users", len(c.snapshots))
+}
+
+func (c *MonzoSnapshotCollector) ResetDay() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	resetDay(c.snapshots)
+	log.Printf("ResetDay: Reset snapshots of %d users", len(c.snapshots))
+}
+
+func (c *MonzoSnapshotCollector) age() time.Duration {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return time.Since(c.collectedAt)
+}
+
+func (c *MonzoSnapshotCollector) refreshIfOld() {
+	if c.refresh == nil || c.minAge == 0 {
+		return
+	}
+
+	// Concurrent scrapes wait for the same refresh rather than starting more
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	age := c.age()
+	if age < c.minAge {
+		return
+	}
+
+	log.Printf("refreshIfOld: Snapshots are %s old, refreshing", age)
+	err := c.refresh(func() bool {
+		return c.age() >= c.minAge
+	})
+	if err != nil {
+		log.Printf("refreshIfOld: Encountered error refreshing => %s", err)
+	}
+}
+
+func (c *MonzoSnapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, metric := range snapshotMetrics {
+		ch <- metric.Desc
+	}
+}
+
+func (c *MonzoSnapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	c.refreshIfOld()
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, snapshot := range c.snapshots {
+		for _, sample := range snapshot.Samples() {
+			ch <- prometheus.MustNewConstMetric(
+				sample.Metric.Desc, prometheus.GaugeValue,
+				sample.Value, sample.LabelValues...,
+			)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScrapeWaitingForCollectionDoesNotCollectAgain(t *testing.T) {
+	var snapshotCollector *MonzoSnapshotCollector
+
+	lock := sync.Mutex{}
+	collections := 0
+	started := make(chan bool)
+	release := make(chan bool)
+
+	collector := &MonzoCollector{
+		usingAccessTokens: func(func([]string) error) error {
+			lock.Lock()
+			collections++
+			first := collections == 1
+			lock.Unlock()
+
+			if first {
+				started <- true
+				<-release
+			}
+
+			snapshotCollector.Publish(MonzoCollectCycle{CollectedAt: time.Now()})
+			return nil
+		},
+	}
+	snapshotCollector = NewMonzoSnapshotCollector(time.Minute, collector.CollectIfNeeded)
+
+	done := make(chan bool)
+	go func() {
+		collector.CollectNow()
+		done <- true
+	}()
+	<-started
+
+	// The scrape finds the snapshots old, then waits for the running cycle
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		release <- true
+	}()
+	snapshotCollector.refreshIfOld()
+	<-done
+
+	if collections != 1 {
+		t.Errorf("expected the scrape to use the running collection, got %d collections", collections)
+	}
+
+	// Once the snapshots are old again a scrape collects
+	snapshotCollector.minAge = time.Nanosecond
+	snapshotCollector.refreshIfOld()
+
+	if collections != 2 {
+		t.Errorf("expected old snapshots to be collected again, got %d collections", collections)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// publishedSeries are the values set in the GaugeVec of a snapshotMetric,
+// keyed by their labels such as "account_id=acc_1,user_id=user_1"
+func publishedSeries(t *testing.T, metric *snapshotMetric) map[string]float64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metric.Vec)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := make([]string, 0)
+			for _, label := range m.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			sort.Strings(labels)
+
+			series[strings.Join(labels, ",")] = m.GetGauge().GetValue()
+		}
+	}
+	return series
+}
+
+func testUserSnapshot(
+	userID MonzoUserID, accounts ...*MonzoAccountSnapshot,
+) *MonzoUserSnapshot {
+	return &MonzoUserSnapshot{
+		UserID:      userID,
+		CollectedAt: time.Now(),
+		Accounts:    accounts,
+	}
+}
+
+func testAccountSnapshot(
+	accountID MonzoAccountID, balance int64, pots ...MonzoPot,
+) *MonzoAccountSnapshot {
+	return &MonzoAccountSnapshot{
+		AccountID: accountID,
+		Balance:   &MonzoBalance{Balance: balance},
+		Pots:      pots,
+	}
+}
+
+func TestGaugeSnapshotPublisherDeletesStaleSeries(t *testing.T) {
+	holiday := MonzoPot{ID: "pot_holiday", Name: "Holiday", Balance: 500}
+	rainyDay := MonzoPot{ID: "pot_rainy_day", Name: "Rainy day", Balance: 900}
+
+	cases := map[string]struct {
+		next MonzoCollectCycle
+
+		balances map[string]float64
+		pots     map[string]float64
+	}{
+		"removed pot": {
+			next: MonzoCollectCycle{Snapshots: []*MonzoUserSnapshot{
+				testUserSnapshot("user_1", testAccountSnapshot("acc_1", 150, holiday)),
+				testUserSnapshot("user_2", testAccountSnapshot("acc_3", 300)),
+			}},
+			balances: map[string]float64{
+				"account_id=acc_1,user_id=user_1": 150,
+				"account_id=acc_3,user_id=user_2": 300,
+			},
+			pots: map[string]float64{"pot_id=pot_holiday,pot_name=Holiday,user_id=user_1": 500},
+		},
+		"closed account": {
+			next: MonzoCollectCycle{Snapshots: []*MonzoUserSnapshot{
+				testUserSnapshot("user_1", testAccountSnapshot("acc_1", 150, holiday, rainyDay)),
+				testUserSnapshot("user_2"),
+			}},
+			balances: map[string]float64{"account_id=acc_1,user_id=user_1": 150},
+			pots: map[string]float64{
+				"pot_id=pot_holiday,pot_name=Holiday,user_id=user_1":     500,
+				"pot_id=pot_rainy_day,pot_name=Rainy day,user_id=user_1": 900,
+			},
+		},
+		"failed stages": {
+			next: MonzoCollectCycle{Snapshots: []*MonzoUserSnapshot{
+				testUserSnapshot("user_1", &MonzoAccountSnapshot{AccountID: "acc_1"}),
+				testUserSnapshot("user_2", testAccountSnapshot("acc_3", 300)),
+			}},
+			balances: map[string]float64{
+				"account_id=acc_1,user_id=user_1": 100,
+				"account_id=acc_3,user_id=user_2": 300,
+			},
+			pots: map[string]float64{
+				"pot_id=pot_holiday,pot_name=Holiday,user_id=user_1":     500,
+				"pot_id=pot_rainy_day,pot_name=Rainy day,user_id=user_1": 900,
+			},
+		},
+		"failed user": {
+			next: MonzoCollectCycle{
+				Snapshots: []*MonzoUserSnapshot{
+					testUserSnapshot("user_2", testAccountSnapshot("acc_3", 300)),
+				},
+				FailedUsers: []MonzoUserID{"user_1"},
+			},
+			balances: map[string]float64{
+				"account_id=acc_1,user_id=user_1": 100,
+				"account_id=acc_3,user_id=user_2": 300,
+			},
+			pots: map[string]float64{
+				"pot_id=pot_holiday,pot_name=Holiday,user_id=user_1":     500,
+				"pot_id=pot_rainy_day,pot_name=Rainy day,user_id=user_1": 900,
+			},
+		},
+		"unidentified token": {
+			next: MonzoCollectCycle{
+				Snapshots: []*MonzoUserSnapshot{
+					testUserSnapshot("user_2", testAccountSnapshot("acc_3", 300)),
+				},
+				Unidentified: 1,
+			},
+			balances: map[string]float64{
+				"account_id=acc_1,user_id=user_1": 100,
+				"account_id=acc_3,user_id=user_2": 300,
+			},
+			pots: map[string]float64{
+				"pot_id=pot_holiday,pot_name=Holiday,user_id=user_1":     500,
+				"pot_id=pot_rainy_day,pot_name=Rainy day,user_id=user_1": 900,
+			},
+		},
+		"removed token": {
+			next: MonzoCollectCycle{Snapshots: []*MonzoUserSnapshot{
+				testUserSnapshot("user_2", testAccountSnapshot("acc_3", 300)),
+			}},
+			balances: map[string]float64{"account_id=acc_3,user_id=user_2": 300},
+			pots:     map[string]float64{},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			for _, metric := range snapshotMetrics {
+				metric.Vec.Reset()
+			}
+
+			publisher := NewGaugeSnapshotPublisher()
+			publisher.Publish(MonzoCollectCycle{Snapshots: []*MonzoUserSnapshot{
+				testUserSnapshot("user_1", testAccountSnapshot("acc_1", 100, holiday, rainyDay)),
+				testUserSnapshot("user_2",
+					testAccountSnapshot("acc_2", 200), testAccountSnapshot("acc_3", 300),
+				),
+			}})
+			publisher.Publish(c.next)
+
+			for metric, expected := range map[*snapshotMetric]map[string]float64{
+				currentBalanceMetric: c.balances,
+				potBalanceMetric:     c.pots,
+			} {
+				series := publishedSeries(t, metric)
+				if len(series) != len(expected) {
+					t.Errorf("expected %s to be %v, got %v", metric.Name, expected, series)
+					continue
+				}
+
+				for labels, value := range expected {
+					if published, ok := series[labels]; !ok || published != value {
+						t.Errorf("expected %s to be %v, got %v", metric.Name, expected, series)
+					}
+				}
+			}
+
+			users := publishedSeries(t, userLatestCollectMetric)
+			for _, snapshot := range publisher.snapshots {
+				if _, ok := users["user_id="+string(snapshot.UserID)]; !ok {
+					t.Errorf("expected the latest collection of %s to be published", snapshot.UserID)
+				}
+			}
+			if len(users) != len(publisher.snapshots) {
+				t.Errorf("expected only the latest collection of kept users, got %v", users)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	SPEND_WINDOW_7_DAYS        = "7d"
+	SPEND_WINDOW_30_DAYS       = "30d"
+	SPEND_WINDOW_MONTH_TO_DATE = "mtd"
+	SPEND_WINDOW_YEAR_TO_DATE  = "ytd"
+)
+
+// MonthStartDay is the day of the month on which months start for the
+// month to date window, months shorter than it start on their last day
+var MonthStartDay = 1
+
+// MonzoSpendWindow is a window of spending which started at Since and runs
+// up to now
+type MonzoSpendWindow struct {
+	Name  string
+	Since time.Time
+}
+
+type MonzoSpendWindowSummary struct {
+	Window   string
+	Category string
+	Currency MonzoCurrency
+	Amount   int64
+}
+
+// SpendWindows are the windows of spending at now, in whole days in
+// DayLocation including today
+func SpendWindows(now time.Time) []MonzoSpendWindow {
+	today := StartOfDay(now)
+
+	return []MonzoSpendWindow{
+		{Name: SPEND_WINDOW_7_DAYS, Since: today.AddDate(0, 0, -6)},
+		{Name: SPEND_WINDOW_30_DAYS, Since: today.AddDate(0, 0, -29)},
+		{Name: SPEND_WINDOW_MONTH_TO_DATE, Since: startOfMonth(today)},
+		{Name: SPEND_WINDOW_YEAR_TO_DATE, Since: time.Date(
+			today.Year(), time.January, 1, 0, 0, 0, 0, DayLocation,
+		)},
+	}
+}
+
+// startOfMonth is the latest MonthStartDay at or before today
+func startOfMonth(today time.Time) time.Time {
+	year, month, day := today.Date()
+
+	if day < monthStartDayIn(year, month) {
+		month--
+	}
+
+	// time.Date normalises month 0 to December of the previous year
+	first := time.Date(year, month, 1, 0, 0, 0, 0, DayLocation)
+	return first.AddDate(0, 0, monthStartDayIn(first.Year(), first.Month())-1)
+}
+
+func monthStartDayIn(year int, month time.Month) int {
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, DayLocation).Day()
+	if MonthStartDay > lastDay {
+		return lastDay
+	}
+	return MonthStartDay
+}
+
+// CoveredSpendWindows leaves out windows which started before historyStart,
+// as the transactions which would be missing from them would make them look
+// smaller than they were
+func CoveredSpendWindows(
+	windows []MonzoSpendWindow, historyStart time.Time,
+) []MonzoSpendWindow {
+	covered := make([]MonzoSpendWindow, 0, len(windows))
+	for _, window := range windows {
+		if !window.Since.Before(historyStart) {
+			covered = append(covered, window)
+		}
+	}
+	return covered
+}
+
+// earliestSpendWindow is when the longest of the windows started
+func earliestSpendWindow(windows []MonzoSpendWindow) time.Time {
+	earliest := windows[0].Since
+	for _, window := range windows {
+		if window.Since.Before(earliest) {
+			earliest = window.Since
+		}
+	}
+	return earliest
+}
+
+// SummariseSpendWindows adds up the amount spent per window, category and
+// currency, which excludes income, declined transactions and anything else
+// Monzo does not include in spending, such as pot deposits
+//
+// The transactions must not go back further than the earliest window
+func SummariseSpendWindows(
+	windows []MonzoSpendWindow,
+	transactions []MonzoTransaction,
+) []MonzoSpendWindowSummary {
+	summaries := make(map[MonzoSpendWindowSummary]int64)
+
+	for _, transaction := range transactions {
+		if !transaction.IsSpending() {
+			continue
+		}
+
+		// Every window gets a summary, so that a category does not disappear
+		// from the shorter windows when nothing was spent in them
+		for _, window := range windows {
+			key := MonzoSpendWindowSummary{
+				Window:   window.Name,
+				Category: transaction.Category,
+				Currency: transaction.Currency,
+			}
+
+			if _, ok := summaries[key]; !ok {
+				summaries[key] = 0
+			}
+
+			if !transaction.Created.Before(window.Since) {
+				summaries[key] -= transaction.Amount
+			}
+		}
+	}
+
+	summaryList := make([]MonzoSpendWindowSummary, 0, len(summaries))
+	for summary, amount := range summaries {
+		summary.Amount = amount
+		summaryList = append(summaryList, summary)
+	}
+	return summaryList
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useDays sets where days start and which day months start on until the test
+// finishes
+func useDays(t *testing.T, location *time.Location, monthStartDay int) {
+	previousLocation, previousMonthStartDay := DayLocation, MonthStartDay
+	DayLocation, MonthStartDay = location, monthStartDay
+
+	t.Cleanup(func() {
+		DayLocation, MonthStartDay = previousLocation, previousMonthStartDay
+	})
+}
+
+func TestStartOfMonth(t *testing.T) {
+	cases := []struct {
+		monthStartDay int
+		today         string
+		expected      string
+	}{
+		{1, "2021-03-01", "2021-03-01"},
+		{1, "2021-03-31", "2021-03-01"},
+		{25, "2021-03-25", "2021-03-25"},
+		{25, "2021-03-24", "2021-02-25"},
+		{25, "2021-01-10", "2020-12-25"},
+		{31, "2021-02-28", "2021-02-28"},
+		{31, "2021-03-30", "2021-02-28"},
+		{31, "2021-04-30", "2021-04-30"},
+		{30, "2024-02-29", "2024-02-29"},
+		{30, "2024-03-01", "2024-02-29"},
+	}
+
+	for _, c := range cases {
+		useDays(t, time.UTC, c.monthStartDay)
+
+		today, _ := time.ParseInLocation("2006-01-02", c.today, DayLocation)
+		started := startOfMonth(today).Format("2006-01-02")
+
+		if started != c.expected {
+			t.Errorf(
+				"expected months starting on day %d to have started on %s by %s, got %s",
+				c.monthStartDay, c.expected, c.today, started,
+			)
+		}
+	}
+}
+
+func TestSpendWindowsAcrossDaylightSaving(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("no timezone data => %s", err)
+	}
+	useDays(t, london, 1)
+
+	// Just after midnight in London, which is still the previous day in UTC
+	now := time.Date(2021, time.March, 30, 0, 30, 0, 0, london)
+
+	expected := map[string]time.Time{
+		SPEND_WINDOW_7_DAYS:        time.Date(2021, time.March, 24, 0, 0, 0, 0, london),
+		SPEND_WINDOW_30_DAYS:       time.Date(2021, time.March, 1, 0, 0, 0, 0, london),
+		SPEND_WINDOW_MONTH_TO_DATE: time.Date(2021, time.March, 1, 0, 0, 0, 0, london),
+		SPEND_WINDOW_YEAR_TO_DATE:  time.Date(2021, time.January, 1, 0, 0, 0, 0, london),
+	}
+
+	for _, window := range SpendWindows(now) {
+		if !window.Since.Equal(expected[window.Name]) {
+			t.Errorf("expected %s to start at %s, got %s", window.Name, expected[window.Name], window.Since)
+		}
+	}
+}
+
+func TestSummariseSpendWindows(t *testing.T) {
+	useDays(t, time.UTC, 1)
+
+	now := time.Date(2021, time.March, 20, 12, 0, 0, 0, time.UTC)
+	windows := SpendWindows(now)
+
+	potDeposit := testTransaction("tx_pot", now, -1000, true)
+	potDeposit.IncludeInSpending = false
+
+	declined := testTransaction("tx_declined", now, -300, false)
+	declined.DeclineReason = "INSUFFICIENT_FUNDS"
+
+	transactions := []MonzoTransaction{
+		testTransaction("tx_february", now.AddDate(0, 0, -35), -400, true),
+		testTransaction("tx_last_week", now.AddDate(0, 0, -10), -200, true),
+		testTransaction("tx_pending", now, -50, false),
+		testTransaction("tx_income", now, 5000, true),
+		potDeposit,
+		declined,
+	}
+
+	amounts := make(map[string]int64)
+	for _, summary := range SummariseSpendWindows(windows, transactions) {
+		amounts[summary.Window] = summary.Amount
+	}
+
+	expected := map[string]int64{
+		SPEND_WINDOW_7_DAYS:        50,
+		SPEND_WINDOW_30_DAYS:       250,
+		SPEND_WINDOW_MONTH_TO_DATE: 250,
+		SPEND_WINDOW_YEAR_TO_DATE:  650,
+	}
+
+	for window, amount := range expected {
+		if amounts[window] != amount {
+			t.Errorf("expected %d spent in %s, got %d", amount, window, amounts[window])
+		}
+	}
+}
+
+func TestCoveredSpendWindows(t *testing.T) {
+	useDays(t, time.UTC, 1)
+
+	now := time.Date(2021, time.March, 20, 12, 0, 0, 0, time.UTC)
+	windows := SpendWindows(now)
+
+	covered := CoveredSpendWindows(windows, time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC))
+
+	names := make([]string, 0)
+	for _, window := range covered {
+		names = append(names, window.Name)
+	}
+
+	if len(names) != 2 || names[0] != SPEND_WINDOW_7_DAYS || names[1] != SPEND_WINDOW_MONTH_TO_DATE {
+		t.Errorf("expected only 7d and mtd to be covered, got %v", names)
+	}
+
+	if len(CoveredSpendWindows(windows, time.Time{})) != len(windows) {
+		t.Error("expected every window to be covered by the whole history")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	TOKEN_STORE_KEY_LENGTH        = 32
+	TOKEN_STORE_ENCRYPTED_VERSION = 1
+)
+
+// encryptedTokens is the on-disk envelope for an encrypted token store
+//
+// The ciphertext is AES-256-GCM sealed, with the version and key id used as
+// additional data so they cannot be tampered with independently
+type encryptedTokens struct {
+	Version    int    `json:"version"`
+	KeyID      string `json:"key_id"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// tokenStoreKeyID identifies a key without revealing it, so that errors can
+// say which key a store was encrypted with
+func tokenStoreKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func tokenStoreAdditionalData(version int, keyID string) []byte {
+	return []byte(fmt.Sprintf("monzo-exporter-tokens/v%d/%s", version, keyID))
+}
+
+func newTokenStoreAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptTokens(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newTokenStoreAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := tokenStoreKeyID(key)
+	envelope := encryptedTokens{
+		Version: TOKEN_STORE_ENCRYPTED_VERSION,
+		KeyID:   keyID,
+		Nonce:   nonce,
+		Ciphertext: aead.Seal(
+			nil, nonce, plaintext,
+			tokenStoreAdditionalData(TOKEN_STORE_ENCRYPTED_VERSION, keyID),
+		),
+	}
+
+	return json.Marshal(envelope)
+}
+
+func decryptTokens(key []byte, contents []byte) ([]byte, error) {
+	var envelope encryptedTokens
+
+	err := json.Unmarshal(contents, &envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if envelope.Version != TOKEN_STORE_ENCRYPTED_VERSION {
+		return nil, fmt.Errorf(
+			"unsupported encrypted token store version %d", envelope.Version,
+		)
+	}
+
+	keyID := tokenStoreKeyID(key)
+	if envelope.KeyID != keyID {
+		return nil, fmt.Errorf(
+			"token store is encrypted with key %s but the configured key is %s",
+			envelope.KeyID, keyID,
+		)
+	}
+
+	aead, err := newTokenStoreAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("token store nonce has the wrong length")
+	}
+
+	plaintext, err := aead.Open(
+		nil, envelope.Nonce, envelope.Ciphertext,
+		tokenStoreAdditionalData(envelope.Version, envelope.KeyID),
+	)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"token store could not be authenticated with key %s => %s", keyID, err,
+		)
+	}
+
+	return plaintext, nil
+}
+
+// LoadTokenStoreKey reads a hex encoded 32 byte key either directly or from a
+// file, returning nil when neither is given
+func LoadTokenStoreKey(key string, keyFile string) ([]byte, error) {
+	if key != "" && keyFile != "" {
+		return nil, fmt.Errorf("only one of a key and a key file can be given")
+	}
+
+	if keyFile != "" {
+		contents, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key file %s => %s", keyFile, err)
+		}
+		key = string(contents)
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, nil
+	}
+
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex encoded => %s", err)
+	}
+
+	if len(decoded) != TOKEN_STORE_KEY_LENGTH {
+		return nil, fmt.Errorf(
+			"key must be %d bytes, got %d", TOKEN_STORE_KEY_LENGTH, len(decoded),
+		)
+	}
+
+	return decoded, nil
+}
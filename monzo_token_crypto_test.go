@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptTokensRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, TOKEN_STORE_KEY_LENGTH)
+	plaintext := []byte(`[{"user_id":"user_00001"}]`)
+
+	encrypted, err := encryptTokens(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, plaintext) {
+		t.Fatal("expected the plaintext not to be in the envelope")
+	}
+
+	decrypted, err := decryptTokens(key, encrypted)
+	if err != nil {
+		t.Fatalf("could not decrypt => %s", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("expected %s, got %s", plaintext, decrypted)
+	}
+}
+
+func TestDecryptTokensRejectsTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, TOKEN_STORE_KEY_LENGTH)
+
+	encrypted, err := encryptTokens(key, []byte(`[]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tamper := func(change func(*encryptedTokens)) []byte {
+		var envelope encryptedTokens
+		if err := json.Unmarshal(encrypted, &envelope); err != nil {
+			t.Fatal(err)
+		}
+		change(&envelope)
+
+		contents, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents
+	}
+
+	cases := map[string][]byte{
+		"ciphertext": tamper(func(e *encryptedTokens) { e.Ciphertext[0] ^= 1 }),
+		"nonce":      tamper(func(e *encryptedTokens) { e.Nonce[0] ^= 1 }),
+		"short nonce": tamper(func(e *encryptedTokens) {
+			e.Nonce = e.Nonce[1:]
+		}),
+		"version": tamper(func(e *encryptedTokens) { e.Version = 2 }),
+		"key id":  tamper(func(e *encryptedTokens) { e.KeyID = "0000000000000000" }),
+	}
+
+	for name, contents := range cases {
+		if _, err := decryptTokens(key, contents); err == nil {
+			t.Errorf("expected a tampered %s to be rejected", name)
+		}
+	}
+
+	otherKey := bytes.Repeat([]byte{2}, TOKEN_STORE_KEY_LENGTH)
+	if _, err := decryptTokens(otherKey, encrypted); err == nil {
+		t.Error("expected the wrong key to be rejected")
+	}
+}
+
+func TestStartFailsWhenTokenStoreCannotBeDecrypted(t *testing.T) {
+	store := newTestTokenStore(t)
+	err := store.Save([]MonzoAccessAndRefreshTokens{{UserID: "user_00001"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &MonzoOAuthClient{
+		TokenStore: &FileMonzoTokenStore{
+			Path: store.Path,
+			Key:  bytes.Repeat([]byte{2}, TOKEN_STORE_KEY_LENGTH),
+		},
+	}
+
+	_, err = client.Start(0)
+
+	var storeErr *MonzoTokenStoreError
+	if !errors.As(err, &storeErr) || storeErr.Reason != TOKEN_STORE_ERROR_DECRYPT {
+		t.Fatalf("expected a decrypt error, got %v", err)
+	}
+
+	unchanged, err := ioutil.ReadFile(store.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, unchanged) {
+		t.Error("expected the token store to be left untouched")
+	}
+}
+
+func TestRotateTokenStoreKey(t *testing.T) {
+	store := newTestTokenStore(t)
+	err := store.Save([]MonzoAccessAndRefreshTokens{
+		{UserID: "user_00001"}, {UserID: "user_00002"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := bytes.Repeat([]byte{3}, TOKEN_STORE_KEY_LENGTH)
+
+	rotated, err := RotateTokenStoreKey(store.Path, store.Key, newKey)
+	if err != nil {
+		t.Fatalf("could not rotate => %s", err)
+	}
+	if rotated != 2 {
+		t.Errorf("expected 2 tokens to be rotated, got %d", rotated)
+	}
+
+	if _, err := store.Load(); err == nil {
+		t.Error("expected the old key to no longer load the store")
+	}
+
+	tokens, err := (&FileMonzoTokenStore{Path: store.Path, Key: newKey}).Load()
+	if err != nil || len(tokens) != 2 {
+		t.Errorf("expected the new key to load 2 tokens, got %d => %v", len(tokens), err)
+	}
+}
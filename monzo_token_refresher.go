@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	TOKEN_REFRESH_MIN_BACKOFF = 10 * time.Second
+	TOKEN_REFRESH_MAX_BACKOFF = 15 * time.Minute
+)
+
+type tokenRefreshSchedule struct {
+	RefreshToken MonzoRefreshToken
+	Failures     int
+	NextAttempt  time.Time
+}
+
+// MonzoTokenRefresher refreshes each user's tokens shortly before they expire
+//
+// Every interval it checks which tokens are due, which is the case when they
+// expire within the lead time. Failed refreshes are retried with exponential
+// backoff, which is forgotten once the user's refresh token changes
+type MonzoTokenRefresher struct {
+	client   *MonzoOAuthClient
+	interval time.Duration
+	lead     time.Duration
+	stop     chan bool
+
+	schedules map[MonzoUserID]tokenRefreshSchedule
+}
+
+func NewMonzoTokenRefresher(
+	client *MonzoOAuthClient,
+	interval time.Duration,
+	lead time.Duration,
+) *MonzoTokenRefresher {
+	return &MonzoTokenRefresher{
+		client:    client,
+		interval:  interval,
+		lead:      lead,
+		stop:      make(chan bool),
+		schedules: make(map[MonzoUserID]tokenRefreshSchedule),
+	}
+}
+
+func (r *MonzoTokenRefresher) Stop() {
+	log.Println("Stop: Stopping MonzoTokenRefresher")
+	r.stop <- true
+}
+
+func (r *MonzoTokenRefresher) Serve() {
+	log.Println("Serve: Starting MonzoTokenRefresher")
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.RefreshDueTokens(time.Now())
+
+		select {
+		case <-r.stop:
+			log.Println("Serve: Stopped MonzoTokenRefresher")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *MonzoTokenRefresher) nextRefresh(
+	tokens MonzoAccessAndRefreshTokens,
+) time.Time {
+	schedule, ok := r.schedules[tokens.UserID]
+	if ok && schedule.RefreshToken == tokens.RefreshToken {
+		return schedule.NextAttempt
+	}
+
+	return tokens.ExpiryTime.Add(-r.lead)
+}
+
+func refreshBackoff(failures int) time.Duration {
+	backoff := TOKEN_REFRESH_MIN_BACKOFF
+	for i := 1; i < failures && backoff < TOKEN_REFRESH_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+
+	if backoff > TOKEN_REFRESH_MAX_BACKOFF {
+		return TOKEN_REFRESH_MAX_BACKOFF
+	}
+	return backoff
+}
+
+func (r *MonzoTokenRefresher) RefreshDueTokens(now time.Time) {
+	tokens := r.client.CurrentTokens()
+	users := make(map[MonzoUserID]bool, len(tokens))
+
+	for _, token := range tokens {
+		if token.AuthState != USER_AUTH_STATE_ACTIVE {
+			log.Printf(
+				"RefreshDueTokens: Skipping user %s in state %s",
+				token.UserID, token.AuthState,
+			)
+			continue
+		}
+
+		users[token.UserID] = true
+		nextRefresh := r.nextRefresh(token)
+
+		if now.Before(nextRefresh) {
+			SetAccessTokenNextRefresh(token.UserID, nextRefresh)
+			continue
+		}
+
+		refreshed, err := r.client.RefreshUserTokens(token)
+
+		if err != nil {
+			schedule := r.schedules[token.UserID]
+			if schedule.RefreshToken != token.RefreshToken {
+				schedule = tokenRefreshSchedule{RefreshToken: token.RefreshToken}
+			}
+
+			schedule.Failures++
+			schedule.NextAttempt = now.Add(refreshBackoff(schedule.Failures))
+			r.schedules[token.UserID] = schedule
+
+			log.Printf(
+				"RefreshDueTokens: Failed %d times for user %s, retrying at %s => %s",
+				schedule.Failures, token.UserID, schedule.NextAttempt, err,
+			)
+			IncAccessTokenRefreshes(token.UserID, "failure")
+			SetAccessTokenNextRefresh(token.UserID, schedule.NextAttempt)
+			continue
+		}
+
+		delete(r.schedules, token.UserID)
+		IncAccessTokenRefreshes(token.UserID, "success")
+		SetAccessTokenNextRefresh(token.UserID, r.nextRefresh(refreshed))
+	}
+
+	for userID := range r.schedules {
+		if !users[userID] {
+			delete(r.schedules, userID)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	TOKEN_STORE_MEMORY = "memory"
+	TOKEN_STORE_FILE   = "file"
+
+	TOKEN_STORE_ERROR_READ    = "read"
+	TOKEN_STORE_ERROR_DECODE  = "decode"
+	TOKEN_STORE_ERROR_DECRYPT = "decrypt"
+	TOKEN_STORE_ERROR_ENCRYPT = "encrypt"
+	TOKEN_STORE_ERROR_WRITE   = "write"
+)
+
+// MonzoTokenStoreError carries a reason so that failures can be counted
+type MonzoTokenStoreError struct {
+	Reason string
+	Err    error
+}
+
+func (e *MonzoTokenStoreError) Error() string {
+	return fmt.Sprintf("token store %s error => %s", e.Reason, e.Err)
+}
+
+type MonzoTokenStore interface {
+	Load() ([]MonzoAccessAndRefreshTokens, error)
+	Save([]MonzoAccessAndRefreshTokens) error
+}
+
+// InMemoryMonzoTokenStore keeps nothing, tokens only live in the TokensBox
+type InMemoryMonzoTokenStore struct{}
+
+func (s *InMemoryMonzoTokenStore) Load() ([]MonzoAccessAndRefreshTokens, error) {
+	return make([]MonzoAccessAndRefreshTokens, 0), nil
+}
+
+func (s *InMemoryMonzoTokenStore) Save(tokens []MonzoAccessAndRefreshTokens) error {
+	return nil
+}
+
+// FileMonzoTokenStore writes tokens as JSON to Path
+//
+// Writes go to a temporary file in the same directory which is synced and
+// then renamed over Path, so a crash mid-write leaves the previous tokens
+//
+// When Key is set the JSON is encrypted before being written. A plaintext
+// store can still be loaded with a Key, and is encrypted on the next Save
+type FileMonzoTokenStore struct {
+	Path string
+	Key  []byte
+}
+
+func (s *FileMonzoTokenStore) Load() ([]MonzoAccessAndRefreshTokens, error) {
+	tokens := make([]MonzoAccessAndRefreshTokens, 0)
+
+	contents, err := ioutil.ReadFile(s.Path)
+
+	if os.IsNotExist(err) {
+		log.Printf("FileMonzoTokenStore: No tokens at %s, starting empty", s.Path)
+		return tokens, nil
+	}
+
+	if err != nil {
+		return tokens, &MonzoTokenStoreError{
+			TOKEN_STORE_ERROR_READ,
+			fmt.Errorf("could not read %s => %s", s.Path, err),
+		}
+	}
+
+	encrypted := bytes.HasPrefix(bytes.TrimSpace(contents), []byte("{"))
+
+	if encrypted && s.Key == nil {
+		return tokens, &MonzoTokenStoreError{
+			TOKEN_STORE_ERROR_DECRYPT,
+			fmt.Errorf("%s is encrypted but no key was given", s.Path),
+		}
+	}
+
+	if encrypted {
+		contents, err = decryptTokens(s.Key, contents)
+		if err != nil {
+			return tokens, &MonzoTokenStoreError{
+				TOKEN_STORE_ERROR_DECRYPT,
+				fmt.Errorf("could not decrypt %s => %s", s.Path, err),
+			}
+		}
+	} else if s.Key != nil {
+		log.Printf(
+			"FileMonzoTokenStore: %s is not encrypted, it will be on the next save",
+			s.Path,
+		)
+	}
+
+	err = json.Unmarshal(contents, &tokens)
+	if err != nil {
+		return tokens, &MonzoTokenStoreError{
+			TOKEN_STORE_ERROR_DECODE,
+			fmt.Errorf("could not unmarshal %s => %s", s.Path, err),
+		}
+	}
+
+	log.Printf("FileMonzoTokenStore: Loaded %d tokens from %s", len(tokens), s.Path)
+	return tokens, nil
+}
+
+func (s *FileMonzoTokenStore) Save(tokens []MonzoAccessAndRefreshTokens) error {
+	contents, err := json.Marshal(tokens)
+	if err != nil {
+		return fmt.Errorf("FileMonzoTokenStore: Could not marshal tokens => %s", err)
+	}
+
+	if s.Key != nil {
+		contents, err = encryptTokens(s.Key, contents)
+		if err != nil {
+			return &MonzoTokenStoreError{
+				TOKEN_STORE_ERROR_ENCRYPT,
+				fmt.Errorf("could not encrypt tokens => %s", err),
+			}
+		}
+	}
+
+	err = writeFileAtomically(s.Path, contents)
+	if err != nil {
+		return &MonzoTokenStoreError{
+			TOKEN_STORE_ERROR_WRITE,
+			fmt.Errorf("could not save tokens to %s => %s", s.Path, err),
+		}
+	}
+
+	log.Printf("FileMonzoTokenStore: Saved %d tokens to %s", len(tokens), s.Path)
+	return nil
+}
+
+func writeFileAtomically(path string, contents []byte) error {
+	dir := filepath.Dir(path)
+
+	tmpFile, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath)
+
+	err = tmpFile.Chmod(0600)
+	if err == nil {
+		_, err = tmpFile.Write(contents)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	closeErr := tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+
+	return dirFile.Sync()
+}
+
+func NewMonzoTokenStore(kind string, path string, key []byte) (MonzoTokenStore, error) {
+	switch kind {
+	case TOKEN_STORE_MEMORY:
+		if key != nil {
+			return nil, fmt.Errorf("a key cannot be used with the %s token store", kind)
+		}
+		return &InMemoryMonzoTokenStore{}, nil
+	case TOKEN_STORE_FILE:
+		if path == "" {
+			return nil, fmt.Errorf("a path is required for the %s token store", kind)
+		}
+		return &FileMonzoTokenStore{Path: path, Key: key}, nil
+	default:
+		return nil, fmt.Errorf("unknown token store %s", kind)
+	}
+}
+
+// RotateTokenStoreKey re-encrypts the tokens at path from oldKey to newKey
+//
+// Either key can be nil, to encrypt a plaintext store or to decrypt one. The
+// store is replaced atomically and read back before returning
+func RotateTokenStoreKey(path string, oldKey []byte, newKey []byte) (int, error) {
+	oldStore := &FileMonzoTokenStore{Path: path, Key: oldKey}
+	newStore := &FileMonzoTokenStore{Path: path, Key: newKey}
+
+	if _, err := os.Stat(path); err != nil {
+		return 0, fmt.Errorf("could not find token store %s => %s", path, err)
+	}
+
+	tokens, err := oldStore.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	err = newStore.Save(tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	reloaded, err := newStore.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(reloaded) != len(tokens) {
+		return 0, fmt.Errorf(
+			"token store has %d tokens after rotation, expected %d",
+			len(reloaded), len(tokens),
+		)
+	}
+
+	return len(tokens), nil
+}
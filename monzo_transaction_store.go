@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	TRANSACTION_STORE_MEMORY = "memory"
+	TRANSACTION_STORE_LEDGER = "ledger"
+
+	// TRANSACTION_STORE_MEMORY_RETENTION covers the 30 day spend window in any
+	// timezone, older transactions are forgotten unless they are still pending
+	TRANSACTION_STORE_MEMORY_RETENTION = 31 * 24 * time.Hour
+)
+
+// MonzoAccountSyncState is how far the transactions of an account have been
+// synced
+//
+// UserID is the user whose sync first found the account, which never changes
+// so that the counters of a joint account do not move between its users.
+// Cursor is the ID of the newest transaction seen, CursorCreated is when it
+// was created, for carrying on if Monzo no longer knows the Cursor. Pending
+// holds the created time of every transaction which has not yet settled.
+// SyncedFrom is where the first sync started, before which transactions are
+// only found by backfilling. LastRefreshed is when recent transactions were
+// last listed again
+type MonzoAccountSyncState struct {
+	UserID        MonzoUserID        `json:"user_id,omitempty"`
+	AccountID     MonzoAccountID     `json:"account_id"`
+	Cursor        MonzoTransactionID `json:"cursor,omitempty"`
+	CursorCreated time.Time          `json:"cursor_created,omitempty"`
+
+	Pending map[MonzoTransactionID]time.Time `json:"pending,omitempty"`
+
+	SyncedFrom    time.Time `json:"synced_from,omitempty"`
+	LastSynced    time.Time `json:"last_synced"`
+	LastRefreshed time.Time `json:"last_refreshed,omitempty"`
+}
+
+// copy is used by stores so that the Pending map is never shared with a sync
+// which is still changing it
+func (s MonzoAccountSyncState) copy() MonzoAccountSyncState {
+	pending := make(map[MonzoTransactionID]time.Time, len(s.Pending))
+	for id, created := range s.Pending {
+		pending[id] = created
+	}
+
+	s.Pending = pending
+	return s
+}
+
+// MonzoTransactionStore is a ledger of every transaction of each account,
+// alongside how far they have been synced
+type MonzoTransactionStore interface {
+	// SyncState is false if the account has never been synced
+	SyncState(accountID MonzoAccountID) (MonzoAccountSyncState, bool, error)
+
+	// SaveSync upserts transactions by ID and replaces the sync state of the
+	// account together, so the cursor never gets ahead of what is stored.
+	// Transactions are added to the totals of the account, see
+	// countLedgerEntry
+	SaveSync(state MonzoAccountSyncState, transactions []MonzoTransaction) error
+
+	// BackfillState is false if the account has never been backfilled
+	BackfillState(accountID MonzoAccountID) (MonzoAccountBackfillState, bool, error)
+
+	// SaveBackfill upserts transactions by ID and replaces the backfill state
+	// of the account together
+	SaveBackfill(state MonzoAccountBackfillState, transactions []MonzoTransaction) error
+
+	// HistoryStart is when the stored transactions of an account start, so
+	// anything earlier is missing. It is false if the account has never been
+	// synced
+	HistoryStart(accountID MonzoAccountID) (time.Time, bool, error)
+
+	// TransactionsSince lists transactions created at or after since, oldest
+	// first
+	TransactionsSince(
+		accountID MonzoAccountID, since time.Time,
+	) ([]MonzoTransaction, error)
+
+	// Totals lists the totals of every account
+	Totals() ([]MonzoTransactionTotal, error)
+
+	// MerchantTotals lists the merchant totals of every account
+	MerchantTotals() ([]MonzoMerchantTotal, error)
+
+	// Declines lists the decline totals of every account
+	Declines() ([]MonzoDeclineTotal, error)
+}
+
+// MonzoAccountBackfillState is how far the history of an account has been
+// backfilled, from when the account was created up to Before
+//
+// Truncated is true when Monzo no longer allowed the full history to be
+// listed, so only the history since From, the last 90 days, was backfilled
+type MonzoAccountBackfillState struct {
+	AccountID     MonzoAccountID     `json:"account_id"`
+	Cursor        MonzoTransactionID `json:"cursor,omitempty"`
+	CursorCreated time.Time          `json:"cursor_created,omitempty"`
+	From          time.Time          `json:"from,omitempty"`
+	Before        time.Time          `json:"before"`
+
+	Transactions int  `json:"transactions"`
+	Truncated    bool `json:"truncated,omitempty"`
+
+	Complete    bool      `json:"complete"`
+	CompletedAt time.Time `json:"completed_at,omitempty"`
+}
+
+// historyStart is when the stored transactions of an account start, which is
+// where its first sync started, or where its backfill started once complete
+// and as long as it reaches where the first sync started
+//
+// It is false when the account has never been synced
+func historyStart(
+	syncState *MonzoAccountSyncState,
+	backfillState *MonzoAccountBackfillState,
+) (time.Time, bool) {
+	if syncState == nil {
+		return time.Time{}, false
+	}
+
+	if backfillState == nil || !backfillState.Complete ||
+		backfillState.Before.Before(syncState.SyncedFrom) {
+		return syncState.SyncedFrom, true
+	}
+
+	if backfillState.Truncated && backfillState.From.IsZero() {
+		// Backfilled before From was kept
+		return backfillState.CompletedAt.Add(-BACKFILL_LIMITED_HISTORY), true
+	}
+	return backfillState.From, true
+}
+
+type storedAccountTransactions struct {
+	SyncState     *MonzoAccountSyncState
+	BackfillState *MonzoAccountBackfillState
+	Entries       map[MonzoTransactionID]*MonzoLedgerEntry
+	Totals        monzoTransactionTotals
+	Merchants     monzoMerchantTotals
+	Declines      monzoDeclineTotals
+}
+
+// InMemoryMonzoTransactionStore is a ledger which is forgotten when the
+// exporter stops, and which only keeps the transactions of the last
+// TRANSACTION_STORE_MEMORY_RETENTION
+//
+// Its totals start again from nothing when the exporter starts, so only
+// transactions created since then are counted
+type InMemoryMonzoTransactionStore struct {
+	lock      sync.Mutex
+	accounts  map[MonzoAccountID]*storedAccountTransactions
+	startedAt time.Time
+}
+
+func NewInMemoryMonzoTransactionStore() *InMemoryMonzoTransactionStore {
+	return &InMemoryMonzoTransactionStore{
+		accounts:  make(map[MonzoAccountID]*storedAccountTransactions),
+		startedAt: time.Now(),
+	}
+}
+
+func (s *InMemoryMonzoTransactionStore) SyncState(
+	accountID MonzoAccountID,
+) (MonzoAccountSyncState, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok || account.SyncState == nil {
+		return MonzoAccountSyncState{AccountID: accountID}, false, nil
+	}
+	return account.SyncState.copy(), true, nil
+}
+
+func (s *InMemoryMonzoTransactionStore) SaveSync(
+	state MonzoAccountSyncState, transactions []MonzoTransaction,
+) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account := s.upsert(state.AccountID, transactions)
+	copied := state.copy()
+	account.SyncState = &copied
+
+	countFrom := state.SyncedFrom
+	if countFrom.Before(s.startedAt) {
+		countFrom = s.startedAt
+	}
+
+	now := time.Now()
+	for _, transaction := range transactions {
+		entry := account.Entries[transaction.ID]
+		if countLedgerEntry(
+			entry, state, countFrom,
+			account.Totals, account.Declines, account.Merchants, now,
+		) {
+			ObserveCountedTransaction(state.UserID, state.AccountID, transaction)
+		}
+	}
+
+	account.prune(state, now.Add(-TRANSACTION_STORE_MEMORY_RETENTION))
+	return nil
+}
+
+// prune forgets transactions created before retainFrom, unless they are
+// still pending
+func (a *storedAccountTransactions) prune(
+	state MonzoAccountSyncState, retainFrom time.Time,
+) {
+	for id, entry := range a.Entries {
+		if _, pending := state.Pending[id]; pending {
+			continue
+		}
+
+		if entry.Transaction.Created.Before(retainFrom) {
+			delete(a.Entries, id)
+		}
+	}
+}
+
+func (s *InMemoryMonzoTransactionStore) BackfillState(
+	accountID MonzoAccountID,
+) (MonzoAccountBackfillState, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok || account.BackfillState == nil {
+		return MonzoAccountBackfillState{AccountID: accountID}, false, nil
+	}
+	return *account.BackfillState, true, nil
+}
+
+func (s *InMemoryMonzoTransactionStore) SaveBackfill(
+	state MonzoAccountBackfillState, transactions []MonzoTransaction,
+) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account := s.upsert(state.AccountID, transactions)
+	account.BackfillState = &state
+	return nil
+}
+
+// upsert must be called whilst holding the lock
+func (s *InMemoryMonzoTransactionStore) upsert(
+	accountID MonzoAccountID, transactions []MonzoTransaction,
+) *storedAccountTransactions {
+	account, ok := s.accounts[accountID]
+	if !ok {
+		account = &storedAccountTransactions{
+			Entries:   make(map[MonzoTransactionID]*MonzoLedgerEntry),
+			Totals:    make(monzoTransactionTotals),
+			Merchants: make(monzoMerchantTotals),
+			Declines:  make(monzoDeclineTotals),
+		}
+		s.accounts[accountID] = account
+	}
+
+	now := time.Now()
+	for _, transaction := range transactions {
+		entry := upsertLedgerEntry(account.Entries[transaction.ID], transaction, now)
+		account.Entries[transaction.ID] = &entry
+	}
+
+	return account
+}
+
+// HistoryStart is no earlier than TRANSACTION_STORE_MEMORY_RETENTION ago, as
+// older transactions are forgotten
+func (s *InMemoryMonzoTransactionStore) HistoryStart(
+	accountID MonzoAccountID,
+) (time.Time, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	start, synced := historyStart(account.SyncState, account.BackfillState)
+	if !synced {
+		return start, false, nil
+	}
+
+	retainedFrom := time.Now().Add(-TRANSACTION_STORE_MEMORY_RETENTION)
+	if start.Before(retainedFrom) {
+		start = retainedFrom
+	}
+	return start, true, nil
+}
+
+func (s *InMemoryMonzoTransactionStore) TransactionsSince(
+	accountID MonzoAccountID, since time.Time,
+) ([]MonzoTransaction, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	transactions := make([]MonzoTransaction, 0)
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return transactions, nil
+	}
+
+	for _, entry := range account.Entries {
+		if !entry.Transaction.Created.Before(since) {
+			transactions = append(transactions, entry.Transaction)
+		}
+	}
+
+	sort.Slice(transactions, func(i, j int) bool {
+		if transactions[i].Created.Equal(transactions[j].Created.Time) {
+			return transactions[i].ID < transactions[j].ID
+		}
+		return transactions[i].Created.Before(transactions[j].Created.Time)
+	})
+
+	return transactions, nil
+}
+
+func (s *InMemoryMonzoTransactionStore) Totals() ([]MonzoTransactionTotal, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	totals := make([]MonzoTransactionTotal, 0)
+	for _, account := range s.accounts {
+		totals = append(totals, account.Totals.list()...)
+	}
+	return totals, nil
+}
+
+func (s *InMemoryMonzoTransactionStore) MerchantTotals() ([]MonzoMerchantTotal, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	merchants := make([]MonzoMerchantTotal, 0)
+	for _, account := range s.accounts {
+		merchants = append(merchants, account.Merchants.list()...)
+	}
+	return merchants, nil
+}
+
+func (s *InMemoryMonzoTransactionStore) Declines() ([]MonzoDeclineTotal, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	declines := make([]MonzoDeclineTotal, 0)
+	for _, account := range s.accounts {
+		declines = append(declines, account.Declines.list()...)
+	}
+	return declines, nil
+}
+
+func NewMonzoTransactionStore(kind string, path string) (MonzoTransactionStore, error) {
+	switch kind {
+	case TRANSACTION_STORE_MEMORY:
+		return NewInMemoryMonzoTransactionStore(), nil
+	case TRANSACTION_STORE_LEDGER:
+		return NewLedgerMonzoTransactionStore(path)
+	default:
+		return nil, fmt.Errorf("unknown transaction store %s", kind)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tlwr/monzo-exporter/monzo"
+)
+
+const (
+	// TRANSACTION_PENDING_MAX_AGE is when a transaction which has still not
+	// settled stops being checked
+	TRANSACTION_PENDING_MAX_AGE = 30 * 24 * time.Hour
+
+	// Recent transactions are listed again every TRANSACTION_REFRESH_INTERVAL
+	// to pick up changes to settled transactions, such as categories and notes
+	TRANSACTION_REFRESH_INTERVAL = time.Hour
+	TRANSACTION_REFRESH_WINDOW   = 7 * 24 * time.Hour
+)
+
+// MonzoTransactionSyncResult holds every transaction which was listed or
+// fetched again because it was pending
+//
+// New counts transactions seen for the first time, Updated those which were
+// seen before and fetched again. UserID is the owner of the account, see
+// MonzoAccountSyncState
+type MonzoTransactionSyncResult struct {
+	UserID       MonzoUserID
+	Transactions []MonzoTransaction
+	New          int
+	Updated      int
+}
+
+// MonzoTransactionSyncer keeps a MonzoTransactionStore up to date with Monzo
+//
+// The first sync of an account lists transactions from a given time. After
+// that only transactions newer than the cursor are listed, a page at a time,
+// and transactions which were pending are fetched again until they settle.
+// Every so often recent transactions are listed again in case they changed
+type MonzoTransactionSyncer struct {
+	store    MonzoTransactionStore
+	pageSize int
+}
+
+func NewMonzoTransactionSyncer(store MonzoTransactionStore) *MonzoTransactionSyncer {
+	return &MonzoTransactionSyncer{
+		store:    store,
+		pageSize: monzo.MaxTransactionsLimit,
+	}
+}
+
+func isPendingTransaction(transaction MonzoTransaction) bool {
+	return !transaction.IsSettled() && !transaction.IsDeclined()
+}
+
+// SyncAccount brings the stored transactions of an account up to date
+//
+// Progress is saved after every page, so a failed sync carries on from where
+// it stopped next time
+func (s *MonzoTransactionSyncer) SyncAccount(
+	ctx context.Context,
+	api MonzoAPI,
+	userID MonzoUserID,
+	accountID MonzoAccountID,
+	initialSince time.Time,
+) (MonzoTransactionSyncResult, error) {
+	result := MonzoTransactionSyncResult{
+		Transactions: make([]MonzoTransaction, 0),
+	}
+
+	state, synced, err := s.store.SyncState(accountID)
+	if err != nil {
+		return result, fmt.Errorf("could not load sync state => %w", err)
+	}
+
+	if state.UserID == "" {
+		state.UserID = userID
+	}
+	result.UserID = state.UserID
+
+	if state.Pending == nil {
+		state.Pending = make(map[MonzoTransactionID]time.Time)
+	}
+
+	previouslyPending := make(map[MonzoTransactionID]time.Time, len(state.Pending))
+	for id, created := range state.Pending {
+		previouslyPending[id] = created
+	}
+
+	if !synced {
+		initialSince, err = s.firstSyncSince(accountID, initialSince)
+		if err != nil {
+			return result, err
+		}
+
+		log.Printf(
+			"SyncAccount: First sync of account %s from %s", accountID, initialSince,
+		)
+		state.SyncedFrom = initialSince
+		state.LastRefreshed = time.Now()
+	}
+
+	listed := make(map[MonzoTransactionID]bool)
+
+	if synced && time.Since(state.LastRefreshed) > TRANSACTION_REFRESH_INTERVAL {
+		err = s.refreshRecent(ctx, api, &state, &result, listed)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	for {
+		query := MonzoTransactionsQuery{Limit: s.pageSize}
+		if state.Cursor != "" {
+			query.SinceID = state.Cursor
+		} else if !state.CursorCreated.IsZero() {
+			query.Since = state.CursorCreated
+		} else {
+			query.Since = initialSince
+		}
+
+		page, err := api.ListTransactions(ctx, accountID, query)
+
+		var apiErr *MonzoAPIError
+		if state.Cursor != "" && errors.As(err, &apiErr) &&
+			(apiErr.IsNotFound() || apiErr.StatusCode == 400) {
+			log.Printf(
+				"SyncAccount: Monzo does not know cursor %s of account %s, carrying on from %s",
+				state.Cursor, accountID, state.CursorCreated,
+			)
+			state.Cursor = ""
+			continue
+		}
+
+		if err != nil {
+			return result, err
+		}
+
+		for _, transaction := range page {
+			listed[transaction.ID] = true
+			s.track(&state, &result, transaction, false)
+
+			state.Cursor = transaction.ID
+			state.CursorCreated = transaction.Created.Time
+		}
+
+		state.LastSynced = time.Now()
+		err = s.store.SaveSync(state, page)
+		if err != nil {
+			return result, fmt.Errorf("could not save transactions => %w", err)
+		}
+
+		if len(page) < s.pageSize {
+			break
+		}
+	}
+
+	err = s.recheckPending(ctx, api, &state, &result, previouslyPending, listed)
+
+	log.Printf(
+		"SyncAccount: Synced account %s with %d new and %d updated transactions, %d pending",
+		accountID, result.New, result.Updated, len(state.Pending),
+	)
+	return result, err
+}
+
+// firstSyncSince is where the first sync of an account starts, which is
+// initialSince, or earlier where a backfill of the account run on its own
+// stopped, so that nothing is missed between the two
+//
+// A backfill which stopped before Monzo's limited history is left alone, as
+// Monzo would not allow listing from there
+func (s *MonzoTransactionSyncer) firstSyncSince(
+	accountID MonzoAccountID, initialSince time.Time,
+) (time.Time, error) {
+	backfillState, backfilled, err := s.store.BackfillState(accountID)
+	if err != nil {
+		return initialSince, fmt.Errorf("could not load backfill state => %w", err)
+	}
+
+	if !backfilled || !backfillState.Before.Before(initialSince) ||
+		time.Since(backfillState.Before) > BACKFILL_LIMITED_HISTORY {
+		return initialSince, nil
+	}
+
+	log.Printf(
+		"firstSyncSince: Account %s was backfilled up to %s, syncing from there",
+		accountID, backfillState.Before,
+	)
+	return backfillState.Before, nil
+}
+
+// recheckPending fetches each transaction which was pending before this sync
+// and was not listed again, as changes to old transactions are never listed
+func (s *MonzoTransactionSyncer) recheckPending(
+	ctx context.Context,
+	api MonzoAPI,
+	state *MonzoAccountSyncState,
+	result *MonzoTransactionSyncResult,
+	previouslyPending map[MonzoTransactionID]time.Time,
+	listed map[MonzoTransactionID]bool,
+) error {
+	rechecked := make([]MonzoTransaction, 0)
+	var recheckErr error
+
+	for id, created := range previouslyPending {
+		if listed[id] {
+			continue
+		}
+
+		if time.Since(created) > TRANSACTION_PENDING_MAX_AGE {
+			log.Printf(
+				"recheckPending: Giving up on transaction %s which has been pending since %s",
+				id, created,
+			)
+			delete(state.Pending, id)
+			continue
+		}
+
+		transaction, err := api.GetTransaction(ctx, id)
+
+		var apiErr *MonzoAPIError
+		if errors.As(err, &apiErr) && apiErr.IsNotFound() {
+			log.Printf("recheckPending: Transaction %s no longer exists", id)
+			delete(state.Pending, id)
+			continue
+		}
+
+		if err != nil {
+			log.Printf("recheckPending: Could not get transaction %s => %s", id, err)
+			if recheckErr == nil {
+				recheckErr = err
+			}
+			continue
+		}
+
+		rechecked = append(rechecked, transaction)
+		s.track(state, result, transaction, true)
+	}
+
+	if len(rechecked) == 0 && len(state.Pending) == len(previouslyPending) {
+		return recheckErr
+	}
+
+	err := s.store.SaveSync(*state, rechecked)
+	if err != nil {
+		return fmt.Errorf("could not save transactions => %w", err)
+	}
+
+	return recheckErr
+}
+
+// refreshRecent lists the transactions of the last TRANSACTION_REFRESH_WINDOW
+// up to the cursor again, without moving the cursor
+func (s *MonzoTransactionSyncer) refreshRecent(
+	ctx context.Context,
+	api MonzoAPI,
+	state *MonzoAccountSyncState,
+	result *MonzoTransactionSyncResult,
+	listed map[MonzoTransactionID]bool,
+) error {
+	since := time.Now().Add(-TRANSACTION_REFRESH_WINDOW)
+	log.Printf(
+		"refreshRecent: Listing transactions of account %s since %s again",
+		state.AccountID, since,
+	)
+
+	query := MonzoTransactionsQuery{Since: since, Limit: s.pageSize}
+
+	for {
+		page, err := api.ListTransactions(ctx, state.AccountID, query)
+		if err != nil {
+			return err
+		}
+
+		refreshed := make([]MonzoTransaction, 0, len(page))
+		for _, transaction := range page {
+			if transaction.Created.After(state.CursorCreated) {
+				break
+			}
+
+			listed[transaction.ID] = true
+			s.track(state, result, transaction, true)
+			refreshed = append(refreshed, transaction)
+		}
+
+		done := len(page) < s.pageSize || len(refreshed) < len(page)
+		if done {
+			state.LastRefreshed = time.Now()
+		}
+
+		err = s.store.SaveSync(*state, refreshed)
+		if err != nil {
+			return fmt.Errorf("could not save transactions => %w", err)
+		}
+
+		if done {
+			return nil
+		}
+
+		query = MonzoTransactionsQuery{
+			SinceID: page[len(page)-1].ID,
+			Limit:   s.pageSize,
+		}
+	}
+}
+
+// track records a transaction in the result and the pending set, known is
+// true for transactions which have been seen before
+func (s *MonzoTransactionSyncer) track(
+	state *MonzoAccountSyncState,
+	result *MonzoTransactionSyncResult,
+	transaction MonzoTransaction,
+	known bool,
+) {
+	if isPendingTransaction(transaction) {
+		state.Pending[transaction.ID] = transaction.Created.Time
+	} else {
+		delete(state.Pending, transaction.ID)
+	}
+
+	if known {
+		result.Updated++
+	} else {
+		result.New++
+	}
+	result.Transactions = append(result.Transactions, transaction)
+}
+
+// PendingTransactions lists the stored transactions of an account which are
+// still being checked until they settle, oldest first
+func (s *MonzoTransactionSyncer) PendingTransactions(
+	accountID MonzoAccountID,
+) ([]MonzoTransaction, error) {
+	pending := make([]MonzoTransaction, 0)
+
+	state, _, err := s.store.SyncState(accountID)
+	if err != nil || len(state.Pending) == 0 {
+		return pending, err
+	}
+
+	oldest := time.Now()
+	for _, created := range state.Pending {
+		if created.Before(oldest) {
+			oldest = created
+		}
+	}
+
+	transactions, err := s.store.TransactionsSince(accountID, oldest)
+	if err != nil {
+		return pending, err
+	}
+
+	for _, transaction := range transactions {
+		if _, ok := state.Pending[transaction.ID]; ok {
+			pending = append(pending, transaction)
+		}
+	}
+	return pending, nil
+}
+
+// TransactionsSince lists the stored transactions of an account
+func (s *MonzoTransactionSyncer) TransactionsSince(
+	accountID MonzoAccountID, since time.Time,
+) ([]MonzoTransaction, error) {
+	return s.store.TransactionsSince(accountID, since)
+}
+
+// HistoryStart is when the stored transactions of an account start, or now
+// if it has never been synced
+func (s *MonzoTransactionSyncer) HistoryStart(
+	accountID MonzoAccountID,
+) (time.Time, error) {
+	start, synced, err := s.store.HistoryStart(accountID)
+	if err != nil || !synced {
+		return time.Now(), err
+	}
+	return start, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tlwr/monzo-exporter/fakemonzo"
+)
+
+func fakeTransaction(id string, created time.Time, settled bool) fakemonzo.Transaction {
+	transaction := fakemonzo.Transaction{
+		"id":                  id,
+		"created":             created.Format(time.RFC3339Nano),
+		"amount":              -100,
+		"currency":            "GBP",
+		"category":            "groceries",
+		"include_in_spending": true,
+	}
+
+	if settled {
+		transaction["settled"] = created.Format(time.RFC3339Nano)
+	}
+	return transaction
+}
+
+func TestSyncAccountCarriesOnFromCursor(t *testing.T) {
+	base := time.Now().UTC().Truncate(time.Second)
+
+	account := &fakemonzo.Account{ID: "acc_sync"}
+	for i := 1; i <= 5; i++ {
+		account.Transactions = append(account.Transactions, fakeTransaction(
+			fmt.Sprintf("tx_%d", i), base.Add(time.Duration(i)*time.Second), i != 3,
+		))
+	}
+
+	fake, _ := startFakeMonzo(t, fakemonzo.Fixtures{
+		Users: []*fakemonzo.User{{
+			UserID:      "user_sync",
+			AccessToken: "token-sync",
+			Approved:    true,
+			Accounts:    []*fakemonzo.Account{account},
+		}},
+	})
+
+	store := NewInMemoryMonzoTransactionStore()
+	syncer := NewMonzoTransactionSyncer(store)
+	syncer.pageSize = 2
+
+	ctx := context.Background()
+	api := NewMonzoAPI("token-sync")
+
+	result, err := syncer.SyncAccount(ctx, api, "user_sync", "acc_sync", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, _, _ := store.SyncState("acc_sync")
+	if result.New != 5 || state.Cursor != "tx_5" || !state.SyncedFrom.Equal(base) {
+		t.Fatalf("expected 5 new transactions up to tx_5, got %d up to %s", result.New, state.Cursor)
+	}
+	if _, pending := state.Pending["tx_3"]; !pending || len(state.Pending) != 1 {
+		t.Errorf("expected only tx_3 to be pending, got %v", state.Pending)
+	}
+	if requests := fake.Requests("/transactions"); requests != 3 {
+		t.Errorf("expected 3 pages, got %d", requests)
+	}
+
+	// Only what is newer than the cursor is listed, and tx_3 is fetched again
+	// as Monzo would not list it now that it has settled
+	fake.Update(func(fixtures *fakemonzo.Fixtures) {
+		account.Transactions[2]["settled"] = base.Format(time.RFC3339Nano)
+		account.Transactions = append(account.Transactions, fakeTransaction(
+			"tx_6", base.Add(6*time.Second), true,
+		))
+	})
+
+	result, err = syncer.SyncAccount(ctx, api, "user_sync", "acc_sync", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, _, _ = store.SyncState("acc_sync")
+	if result.New != 1 || result.Updated != 1 || state.Cursor != "tx_6" {
+		t.Errorf(
+			"expected 1 new and 1 updated transaction up to tx_6, got %d and %d up to %s",
+			result.New, result.Updated, state.Cursor,
+		)
+	}
+	if len(state.Pending) != 0 || fake.Requests("/transactions/tx_3") != 1 {
+		t.Errorf("expected tx_3 to be fetched once and settle, got %v", state.Pending)
+	}
+
+	// When Monzo no longer knows the cursor, the sync carries on from when it
+	// was created
+	fake.Update(func(fixtures *fakemonzo.Fixtures) {
+		account.Transactions[5] = fakeTransaction("tx_7", base.Add(7*time.Second), true)
+	})
+
+	result, err = syncer.SyncAccount(ctx, api, "user_sync", "acc_sync", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, _, _ = store.SyncState("acc_sync")
+	if result.New != 1 || state.Cursor != "tx_7" {
+		t.Errorf("expected to carry on to tx_7, got %d new up to %s", result.New, state.Cursor)
+	}
+
+	stored, err := store.TransactionsSince("acc_sync", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 7 || !stored[2].IsSettled() {
+		t.Errorf("expected 7 stored transactions with tx_3 settled, got %d", len(stored))
+	}
+}
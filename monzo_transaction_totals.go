@@ -0,0 +1,355 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MonzoTransactionTotal is the amount spent and received by an account in a
+// category and currency, since its transactions were first synced
+type MonzoTransactionTotal struct {
+	UserID    MonzoUserID    `json:"user_id"`
+	AccountID MonzoAccountID `json:"account_id"`
+	Category  string         `json:"category"`
+	Currency  MonzoCurrency  `json:"currency"`
+
+	Spend  int64 `json:"spend"`
+	Income int64 `json:"income"`
+}
+
+// monzoTransactionTotals are the totals of an account keyed by category and
+// currency
+type monzoTransactionTotals map[string]MonzoTransactionTotal
+
+func (t monzoTransactionTotals) list() []MonzoTransactionTotal {
+	totals := make([]MonzoTransactionTotal, 0, len(t))
+	for _, total := range t {
+		totals = append(totals, total)
+	}
+	return totals
+}
+
+// MonzoMerchantTotal is the amount spent by an account at a merchant in a
+// currency, and the number of settled transactions with the merchant, since
+// its transactions were first synced
+//
+// MerchantName is the name the merchant had when it was first counted, so
+// that a renamed merchant does not start a new series
+type MonzoMerchantTotal struct {
+	UserID       MonzoUserID     `json:"user_id"`
+	AccountID    MonzoAccountID  `json:"account_id"`
+	MerchantID   MonzoMerchantID `json:"merchant_id"`
+	MerchantName string          `json:"merchant_name"`
+	Currency     MonzoCurrency   `json:"currency"`
+
+	Spend        int64 `json:"spend"`
+	Transactions int64 `json:"transactions"`
+}
+
+// monzoMerchantTotals are the merchant totals of an account keyed by merchant
+// and currency
+type monzoMerchantTotals map[string]MonzoMerchantTotal
+
+func (t monzoMerchantTotals) list() []MonzoMerchantTotal {
+	merchants := make([]MonzoMerchantTotal, 0, len(t))
+	for _, merchant := range t {
+		merchants = append(merchants, merchant)
+	}
+	return merchants
+}
+
+// MonzoDeclineTotal is the number of transactions of an account declined
+// for a reason at merchants in a category, since its transactions were first
+// synced
+type MonzoDeclineTotal struct {
+	UserID           MonzoUserID    `json:"user_id"`
+	AccountID        MonzoAccountID `json:"account_id"`
+	Reason           string         `json:"reason"`
+	MerchantCategory string         `json:"merchant_category"`
+
+	Declined     int64     `json:"declined"`
+	LastDeclined time.Time `json:"last_declined"`
+}
+
+// monzoDeclineTotals are the decline totals of an account keyed by reason
+// and merchant category
+type monzoDeclineTotals map[string]MonzoDeclineTotal
+
+func (t monzoDeclineTotals) list() []MonzoDeclineTotal {
+	declines := make([]MonzoDeclineTotal, 0, len(t))
+	for _, decline := range t {
+		declines = append(declines, decline)
+	}
+	return declines
+}
+
+// declinedMerchantCategory is the category of the merchant, or of the
+// transaction when it has no merchant, such as a declined direct debit
+func declinedMerchantCategory(transaction MonzoTransaction) string {
+	if transaction.Merchant != nil && transaction.Merchant.Category != "" {
+		return transaction.Merchant.Category
+	}
+	return transaction.Category
+}
+
+// countLedgerEntry adds a synced transaction to the totals of its account
+// once it has settled, or to the decline totals when it was declined, and
+// marks it so that it is never counted again
+//
+// Money leaving the account which is not included in spending by Monzo, such
+// as a pot deposit, is marked as counted without being added to the totals
+//
+// Transactions created before countFrom are never counted. For a ledger it is
+// when the account was first synced, as older transactions are only ever
+// backfilled, and for a store which forgets everything when the exporter
+// stops it is when the exporter started, as older transactions may have been
+// counted before
+func countLedgerEntry(
+	entry *MonzoLedgerEntry,
+	state MonzoAccountSyncState,
+	countFrom time.Time,
+	totals monzoTransactionTotals,
+	declines monzoDeclineTotals,
+	merchants monzoMerchantTotals,
+	now time.Time,
+) bool {
+	transaction := entry.Transaction
+
+	if !entry.CountedAt.IsZero() || transaction.Created.Before(countFrom) {
+		return false
+	}
+
+	if transaction.IsDeclined() {
+		countDecline(transaction, state, declines)
+		entry.CountedAt = now
+		return true
+	}
+
+	if !transaction.IsSettled() {
+		return false
+	}
+
+	countMerchantTransaction(transaction, state, merchants)
+
+	// Money moved into pots and the like is neither spend nor income
+	if transaction.Amount < 0 && !transaction.IsSpending() {
+		entry.CountedAt = now
+		return true
+	}
+
+	key := transaction.Category + "/" + string(transaction.Currency)
+	total, ok := totals[key]
+	if !ok {
+		total = MonzoTransactionTotal{
+			UserID:    state.UserID,
+			AccountID: state.AccountID,
+			Category:  transaction.Category,
+			Currency:  transaction.Currency,
+		}
+	}
+
+	if transaction.Amount < 0 {
+		total.Spend -= transaction.Amount
+	} else {
+		total.Income += transaction.Amount
+	}
+
+	totals[key] = total
+	entry.CountedAt = now
+	return true
+}
+
+func countMerchantTransaction(
+	transaction MonzoTransaction,
+	state MonzoAccountSyncState,
+	merchants monzoMerchantTotals,
+) {
+	if transaction.Merchant == nil || transaction.Merchant.ID == "" {
+		return
+	}
+
+	key := string(transaction.Merchant.ID) + "/" + string(transaction.Currency)
+	merchant, ok := merchants[key]
+	if !ok {
+		merchant = MonzoMerchantTotal{
+			UserID:       state.UserID,
+			AccountID:    state.AccountID,
+			MerchantID:   transaction.Merchant.ID,
+			MerchantName: transaction.Merchant.Name,
+			Currency:     transaction.Currency,
+		}
+	}
+
+	merchant.Transactions++
+	if transaction.IsSpending() {
+		merchant.Spend -= transaction.Amount
+	}
+	merchants[key] = merchant
+}
+
+func countDecline(
+	transaction MonzoTransaction,
+	state MonzoAccountSyncState,
+	declines monzoDeclineTotals,
+) {
+	merchantCategory := declinedMerchantCategory(transaction)
+
+	key := transaction.DeclineReason + "/" + merchantCategory
+	decline, ok := declines[key]
+	if !ok {
+		decline = MonzoDeclineTotal{
+			UserID:           state.UserID,
+			AccountID:        state.AccountID,
+			Reason:           transaction.DeclineReason,
+			MerchantCategory: merchantCategory,
+		}
+	}
+
+	decline.Declined++
+	if transaction.Created.After(decline.LastDeclined) {
+		decline.LastDeclined = transaction.Created.Time
+	}
+
+	declines[key] = decline
+}
+
+var (
+	spendTotalDesc = prometheus.NewDesc(
+		"monzo_spend_total",
+		"Shows the amount spent per category and currency by settled transactions since the account was first synced",
+		[]string{"user_id", "account_id", "category", "currency"}, nil,
+	)
+
+	incomeTotalDesc = prometheus.NewDesc(
+		"monzo_income_total",
+		"Shows the amount received per category and currency by settled transactions since the account was first synced",
+		[]string{"user_id", "account_id", "category", "currency"}, nil,
+	)
+
+	declinedTransactionsDesc = prometheus.NewDesc(
+		"monzo_declined_transactions_total",
+		"Shows the number of declined transactions per reason and merchant category since the account was first synced",
+		[]string{"user_id", "account_id", "reason", "merchant_category"}, nil,
+	)
+
+	merchantSpendTotalDesc = prometheus.NewDesc(
+		"monzo_merchant_spend_total",
+		"Shows the amount spent per merchant and currency by settled transactions since the account was first synced",
+		[]string{"user_id", "account_id", "merchant_id", "merchant_name", "currency"}, nil,
+	)
+
+	merchantTransactionsTotalDesc = prometheus.NewDesc(
+		"monzo_merchant_transactions_total",
+		"Shows the number of settled transactions per merchant and currency since the account was first synced",
+		[]string{"user_id", "account_id", "merchant_id", "merchant_name", "currency"}, nil,
+	)
+
+	lastDeclinedTransactionDesc = prometheus.NewDesc(
+		"monzo_last_declined_transaction_timestamp",
+		"Shows the unix timestamp of the most recent declined transaction per account",
+		[]string{"user_id", "account_id"}, nil,
+	)
+)
+
+// MonzoTransactionTotalsCollector serves the totals, merchant totals and
+// decline totals kept by a MonzoTransactionStore as counters on each scrape
+//
+// Each transaction is counted exactly once, when it is saved by a sync after
+// it has settled or been declined, and with a ledger transaction store the totals carry on
+// from where they were after a restart
+type MonzoTransactionTotalsCollector struct {
+	store MonzoTransactionStore
+}
+
+func NewMonzoTransactionTotalsCollector(
+	store MonzoTransactionStore,
+) *MonzoTransactionTotalsCollector {
+	return &MonzoTransactionTotalsCollector{store: store}
+}
+
+func (c *MonzoTransactionTotalsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- spendTotalDesc
+	ch <- incomeTotalDesc
+	ch <- merchantSpendTotalDesc
+	ch <- merchantTransactionsTotalDesc
+	ch <- declinedTransactionsDesc
+	ch <- lastDeclinedTransactionDesc
+}
+
+func (c *MonzoTransactionTotalsCollector) Collect(ch chan<- prometheus.Metric) {
+	totals, err := c.store.Totals()
+	if err != nil {
+		log.Printf("Collect: Could not load transaction totals => %s", err)
+		return
+	}
+
+	for _, total := range totals {
+		labelValues := []string{
+			string(total.UserID), string(total.AccountID),
+			total.Category, string(total.Currency),
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			spendTotalDesc, prometheus.CounterValue,
+			float64(total.Spend), labelValues...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			incomeTotalDesc, prometheus.CounterValue,
+			float64(total.Income), labelValues...,
+		)
+	}
+
+	merchants, err := c.store.MerchantTotals()
+	if err != nil {
+		log.Printf("Collect: Could not load merchant totals => %s", err)
+		return
+	}
+
+	for _, merchant := range merchants {
+		labelValues := []string{
+			string(merchant.UserID), string(merchant.AccountID),
+			string(merchant.MerchantID), merchant.MerchantName,
+			string(merchant.Currency),
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			merchantSpendTotalDesc, prometheus.CounterValue,
+			float64(merchant.Spend), labelValues...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			merchantTransactionsTotalDesc, prometheus.CounterValue,
+			float64(merchant.Transactions), labelValues...,
+		)
+	}
+
+	declines, err := c.store.Declines()
+	if err != nil {
+		log.Printf("Collect: Could not load decline totals => %s", err)
+		return
+	}
+
+	lastDeclined := make(map[[2]string]time.Time)
+
+	for _, decline := range declines {
+		ch <- prometheus.MustNewConstMetric(
+			declinedTransactionsDesc, prometheus.CounterValue,
+			float64(decline.Declined),
+			string(decline.UserID), string(decline.AccountID),
+			decline.Reason, decline.MerchantCategory,
+		)
+
+		account := [2]string{string(decline.UserID), string(decline.AccountID)}
+		if decline.LastDeclined.After(lastDeclined[account]) {
+			lastDeclined[account] = decline.LastDeclined
+		}
+	}
+
+	for account, last := range lastDeclined {
+		ch <- prometheus.MustNewConstMetric(
+			lastDeclinedTransactionDesc, prometheus.GaugeValue,
+			float64(last.Unix()), account[0], account[1],
+		)
+	}
+}
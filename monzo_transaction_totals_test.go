@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tlwr/monzo-exporter/fakemonzo"
+	"github.com/tlwr/monzo-exporter/monzo"
+)
+
+func testTransaction(
+	id string, created time.Time, amount int64, settled bool,
+) MonzoTransaction {
+	transaction := MonzoTransaction{
+		ID:                MonzoTransactionID(id),
+		Created:           monzo.OptionalTime{Time: created},
+		Amount:            amount,
+		Currency:          "GBP",
+		Category:          "groceries",
+		IncludeInSpending: amount < 0,
+		Merchant:          &monzo.Merchant{ID: "merch_1", Name: "Supermarket"},
+	}
+
+	if settled {
+		transaction.Settled = monzo.OptionalTime{Time: created}
+	}
+	return transaction
+}
+
+func TestCountLedgerEntry(t *testing.T) {
+	now := time.Now()
+	countFrom := now.Add(-time.Hour)
+	state := MonzoAccountSyncState{UserID: "user_1", AccountID: "acc_1"}
+
+	potDeposit := testTransaction("tx_pot", now, -1000, true)
+	potDeposit.IncludeInSpending = false
+	potDeposit.Merchant = nil
+
+	declined := testTransaction("tx_declined", now, -300, false)
+	declined.DeclineReason = "INSUFFICIENT_FUNDS"
+
+	cases := []struct {
+		transaction MonzoTransaction
+		counted     bool
+	}{
+		{testTransaction("tx_pending", now, -100, false), false},
+		{testTransaction("tx_old", countFrom.Add(-time.Second), -100, true), false},
+		{testTransaction("tx_spend", now, -250, true), true},
+		{testTransaction("tx_income", now, 5000, true), true},
+		{potDeposit, true},
+		{declined, true},
+	}
+
+	totals := make(monzoTransactionTotals)
+	declines := make(monzoDeclineTotals)
+	merchants := make(monzoMerchantTotals)
+
+	for _, c := range cases {
+		entry := &MonzoLedgerEntry{Transaction: c.transaction}
+
+		counted := countLedgerEntry(entry, state, countFrom, totals, declines, merchants, now)
+		if counted != c.counted {
+			t.Errorf("expected %s to be counted %t", c.transaction.ID, c.counted)
+		}
+
+		if countLedgerEntry(entry, state, countFrom, totals, declines, merchants, now) {
+			t.Errorf("expected %s never to be counted twice", c.transaction.ID)
+		}
+	}
+
+	total := totals["groceries/GBP"]
+	if total.Spend != 250 || total.Income != 5000 || total.UserID != "user_1" {
+		t.Errorf("expected 250 spent and 5000 received, got %+v", total)
+	}
+
+	merchant := merchants["merch_1/GBP"]
+	if merchant.Spend != 250 || merchant.Transactions != 2 ||
+		merchant.MerchantName != "Supermarket" {
+		t.Errorf("expected 250 spent in 2 transactions at the supermarket, got %+v", merchant)
+	}
+
+	if len(declines) != 1 || declines["INSUFFICIENT_FUNDS/groceries"].Declined != 1 {
+		t.Errorf("expected 1 decline, got %+v", declines)
+	}
+}
+
+func TestLedgerTotalsCarryOnAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monzo-exporter-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "ledger.db")
+	now := time.Now()
+
+	state := MonzoAccountSyncState{
+		UserID: "user_1", AccountID: "acc_1", SyncedFrom: now.Add(-time.Hour),
+	}
+	transactions := []MonzoTransaction{
+		testTransaction("tx_1", now, -250, true),
+		testTransaction("tx_2", now, -100, false),
+	}
+
+	ledger, err := NewLedgerMonzoTransactionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ledger.SaveSync(state, transactions); err != nil {
+		t.Fatal(err)
+	}
+	ledger.Close()
+
+	// After a restart, transactions listed again are not counted again, and
+	// those which settled since are
+	ledger, err = NewLedgerMonzoTransactionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+
+	transactions[1] = testTransaction("tx_2", now, -100, true)
+	if err := ledger.SaveSync(state, transactions); err != nil {
+		t.Fatal(err)
+	}
+
+	totals, err := ledger.Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals[0].Spend != 350 {
+		t.Errorf("expected 350 spent, got %+v", totals)
+	}
+
+	merchants, err := ledger.MerchantTotals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merchants) != 1 || merchants[0].Spend != 350 || merchants[0].Transactions != 2 {
+		t.Errorf("expected 350 spent in 2 transactions at the merchant, got %+v", merchants)
+	}
+}
+
+func TestInMemoryTotalsOnlyCountSinceStart(t *testing.T) {
+	store := NewInMemoryMonzoTransactionStore()
+	now := time.Now()
+
+	// The first sync after a restart starts at the start of the day, when
+	// transactions may have been counted before the restart
+	state := MonzoAccountSyncState{
+		UserID: "user_1", AccountID: "acc_1", SyncedFrom: now.Add(-time.Hour),
+	}
+
+	err := store.SaveSync(state, []MonzoTransaction{
+		testTransaction("tx_before", store.startedAt.Add(-time.Minute), -250, true),
+		testTransaction("tx_after", store.startedAt.Add(time.Second), -100, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	totals, err := store.Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(totals) != 1 || totals[0].Spend != 100 {
+		t.Errorf("expected only the transaction since start to be counted, got %+v", totals)
+	}
+}
+
+func TestJointAccountTotalsKeepTheirFirstOwner(t *testing.T) {
+	store := NewInMemoryMonzoTransactionStore()
+	syncer := NewMonzoTransactionSyncer(store)
+
+	now := time.Now().UTC()
+	joint := &fakemonzo.Account{
+		ID:           "acc_joint",
+		Transactions: []fakemonzo.Transaction{fakeTransaction("tx_1", now, true)},
+	}
+
+	fake, _ := startFakeMonzo(t, fakemonzo.Fixtures{
+		Users: []*fakemonzo.User{
+			{UserID: "user_1", AccessToken: "token-1", Approved: true, Accounts: []*fakemonzo.Account{joint}},
+			{UserID: "user_2", AccessToken: "token-2", Approved: true, Accounts: []*fakemonzo.Account{joint}},
+		},
+	})
+
+	ctx := context.Background()
+
+	_, err := syncer.SyncAccount(ctx, NewMonzoAPI("token-1"), "user_1", "acc_joint", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.Update(func(fixtures *fakemonzo.Fixtures) {
+		joint.Transactions = append(joint.Transactions, fakeTransaction(
+			"tx_2", now.Add(time.Second), true,
+		))
+	})
+
+	result, err := syncer.SyncAccount(ctx, NewMonzoAPI("token-2"), "user_2", "acc_joint", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	totals, err := store.Totals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UserID != "user_1" || len(totals) != 1 ||
+		totals[0].UserID != "user_1" || totals[0].Spend != 200 {
+		t.Errorf("expected both transactions to be counted for user_1, got %+v", totals)
+	}
+}
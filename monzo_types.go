@@ -1,101 +1,100 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
-)
-
-type MonzoAccessToken string
-type MonzoAccountID string
-type MonzoClientID string
-type MonzoCurrency string
-type MonzoMerchantID string
-type MonzoPotID string
-type MonzoRefreshToken string
-type MonzoTransactionID string
-type MonzoUserID string
-
-type MonzoAccount struct {
-	ID          MonzoAccountID `json:"id"`
-	Description string         `json:"description"`
-	Created     time.Time      `json:"created"`
-}
-
-type MonzoPot struct {
-	ID MonzoPotID `json:"id"`
 
-	Name string `json:"name"`
-
-	Currency MonzoCurrency `json:"currency"`
-	Balance  int64         `json:"balance"`
+	"github.com/tlwr/monzo-exporter/monzo"
+)
 
-	Created time.Time `json:"created"`
-	Updated time.Time `json:"updated"`
-}
+type MonzoAccessToken = monzo.AccessToken
+type MonzoAccountID = monzo.AccountID
+type MonzoClientID = monzo.ClientID
+type MonzoCurrency = monzo.Currency
+type MonzoMerchantID = monzo.MerchantID
+type MonzoPotID = monzo.PotID
+type MonzoRefreshToken = monzo.RefreshToken
+type MonzoTransactionID = monzo.TransactionID
+type MonzoUserID = monzo.UserID
+
+type MonzoUserAuthState string
+
+const (
+	USER_AUTH_STATE_ACTIVE                 MonzoUserAuthState = "active"
+	USER_AUTH_STATE_PENDING_APPROVAL       MonzoUserAuthState = "pending_approval"
+	USER_AUTH_STATE_NEEDS_REAUTHENTICATION MonzoUserAuthState = "needs_reauthentication"
+)
 
-type MonzoAPIListAccountsResponse struct {
-	Accounts []MonzoAccount `json:"accounts"`
+var MonzoUserAuthStates = []MonzoUserAuthState{
+	USER_AUTH_STATE_ACTIVE,
+	USER_AUTH_STATE_PENDING_APPROVAL,
+	USER_AUTH_STATE_NEEDS_REAUTHENTICATION,
 }
 
-type MonzoAPIListPotsResponse struct {
-	Pots []MonzoPot `json:"pots"`
-}
+type MonzoAccount = monzo.Account
+type MonzoPot = monzo.Pot
+type MonzoBalance = monzo.Balance
+type MonzoCallerIdentity = monzo.CallerIdentity
+type MonzoAuthResponse = monzo.AuthResponse
+type MonzoTransaction = monzo.Transaction
+type MonzoMerchant = monzo.Merchant
+type MonzoCounterparty = monzo.Counterparty
+type MonzoTransactionsQuery = monzo.TransactionsQuery
 
-type MonzoBalance struct {
-	Balance      int64         `json:"balance"`
-	TotalBalance int64         `json:"total_balance"`
-	Currency     MonzoCurrency `json:"currency"`
-	SpendToday   int64         `json:"spend_today"`
+type MonzoTransactionsSummary struct {
+	Description string
+	Category    string
+	Amount      int64
 }
 
-type MonzoCallerIdentity struct {
-	Authenticated bool          `json:"authenticated"`
-	ClientID      MonzoClientID `json:"client_id"`
-	UserID        MonzoUserID   `json:"user_id"`
+// MonzoSettlementSummary splits the transactions of an account into those
+// which are still pending, from any day, and those made today which have
+// settled
+type MonzoSettlementSummary struct {
+	PendingAmount       int64
+	PendingTransactions int
+	OldestPending       time.Time
+	SettledAmountToday  int64
 }
 
-type MonzoAuthResponse struct {
-	AccessToken   MonzoAccessToken  `json:"access_token"`
-	RefreshToken  MonzoRefreshToken `json:"refresh_token"`
-	UserID        MonzoUserID       `json:"user_id"`
-	ExpirySeconds float64           `json:"expires_in"`
-}
+type MonzoAccessAndRefreshTokens struct {
+	AccessToken  MonzoAccessToken  `json:"access_token"`
+	RefreshToken MonzoRefreshToken `json:"refresh_token"`
+	UserID       MonzoUserID       `json:"user_id"`
+	ExpiryTime   time.Time         `json:"expiry_time"`
 
-type MonzoTransaction struct {
-	Amount      int            `json:"amount"`
-	Currency    MonzoCurrency  `json:"currency"`
-	AccountID   MonzoAccountID `json:"account_id"`
-	UserID      MonzoUserID    `json:"user_id"`
-	Category    string         `json:"category"`
-	Description string         `json:"description"`
+	AuthState MonzoUserAuthState `json:"auth_state,omitempty"`
 }
 
-type MonzoTransactionsResponse struct {
-	Transactions []MonzoTransaction `json:"transactions"`
+type ConcurrentMonzoTokensBox struct {
+	Lock   sync.Mutex
+	Tokens map[MonzoUserID]MonzoAccessAndRefreshTokens
+	Store  MonzoTokenStore
 }
 
-type MonzoTransactionsSummary struct {
-	Description string
-	Category    string
-	Amount      int
-}
+// tokensList must be called whilst holding the Lock
+func (b *ConcurrentMonzoTokensBox) tokensList() []MonzoAccessAndRefreshTokens {
+	tokens := make([]MonzoAccessAndRefreshTokens, 0, len(b.Tokens))
+	for _, token := range b.Tokens {
+		tokens = append(tokens, token)
+	}
 
-type MonzoAccessAndRefreshTokens struct {
-	AccessToken  MonzoAccessToken
-	RefreshToken MonzoRefreshToken
-	UserID       MonzoUserID
-	ExpiryTime   time.Time
-}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].UserID < tokens[j].UserID
+	})
 
-type ConcurrentMonzoTokensBox struct {
-	Lock   sync.Mutex
-	Tokens []MonzoAccessAndRefreshTokens
+	return tokens
 }
 
 type MonzoOAuthClient struct {
 	MonzoOAuthClientID     string
 	MonzoOAuthClientSecret string
 	ExternalURL            string
+	AuthURL                string
+	TokenStore             MonzoTokenStore
 
 	TokensBox ConcurrentMonzoTokensBox
+
+	sessions statusSessions
 }